@@ -0,0 +1,74 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+/*
+#cgo !windows LDFLAGS: -lrtlsdr
+#cgo windows CFLAGS: -IC:/WINDOWS/system32
+#cgo windows LDFLAGS: -lrtlsdr -LC:/WINDOWS/system32
+
+#include <stdint.h>
+#include <rtl-sdr.h>
+
+extern void rtlsdrAsyncCallback(unsigned char *buf, uint32_t len, void *ctx);
+
+// the receiver's handle is the context librtlsdr gives the callback
+static inline int read_async(rtlsdr_dev_t *dev, uintptr_t handle, uint32_t buf_len) {
+	return rtlsdr_read_async(dev, (rtlsdr_read_async_cb_t)rtlsdrAsyncCallback, (void *)handle, 0, buf_len);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"runtime/cgo"
+	"sync/atomic"
+	"unsafe"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+// readAsync reads from dev until it's cancelled, passing each transfer to
+// the receiver's callback. gortlsdr's ReadAsync takes a single callback for
+// the whole process, so librtlsdr is called directly, letting the callback
+// find the receiver a transfer belongs to; unlike reading synchronously,
+// there are always transfers queued, so no samples are lost between reads.
+func (r *Receiver) readAsync(dev *rtl.Context) error {
+	h := cgo.NewHandle(r)
+	defer h.Delete()
+
+	i := int(C.read_async((*C.rtlsdr_dev_t)(unsafe.Pointer(dev)), C.uintptr_t(h), C.uint32_t(readLen)))
+	if i != 0 {
+		return fmt.Errorf("rtlsdr_read_async returned %d", i)
+	}
+	return nil
+}
+
+//export rtlsdrAsyncCallback
+func rtlsdrAsyncCallback(buf *C.uchar, n C.uint32_t, ctx unsafe.Pointer) {
+	r := cgo.Handle(uintptr(ctx)).Value().(*Receiver)
+	r.asyncCallback(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(n)))
+}
+
+// asyncCallback takes a transfer read by readAsync, within the goroutine
+// calling it, and cancels the reads once the receiver has stopped
+func (r *Receiver) asyncCallback(buf []byte) {
+	if r.ctx.Err() != nil {
+		r.dongle.dev.CancelAsync()
+		return
+	}
+	atomic.AddUint64(&r.metrics.buffers, 1)
+	r.rtlsdrCallback(buf)
+}
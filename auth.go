@@ -0,0 +1,163 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	// listeners may watch and listen, but not retune the receivers
+	roleListen  = "listen"
+	roleControl = "control"
+)
+
+// credential lets a client in with a role, either by basic auth with the
+// name and secret, or by the secret alone as a bearer token or ?token=, as
+// browsers can't give headers when opening a WebSocket
+type credential struct {
+	role   string
+	name   string
+	secret string
+}
+
+// loadCredentials reads the -auth file, of lines of role, name and secret:
+//
+//	# role   name     secret
+//	control  alice    correct-horse-battery-staple
+//	listen   pi-feed  6d1f0c7e9b
+func loadCredentials(filename string) (creds []credential, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected role, name and secret", filename, line)
+		}
+		if fields[0] != roleListen && fields[0] != roleControl {
+			return nil, fmt.Errorf("%s:%d: role must be %s or %s", filename, line, roleListen, roleControl)
+		}
+		creds = append(creds, credential{role: fields[0], name: fields[1], secret: fields[2]})
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("%s gives no credentials", filename)
+	}
+	return
+}
+
+// checkTLS loads the certificate and key, so a mistake is found on starting
+// rather than by the first client
+func checkTLS(cert, key string) error {
+	if (cert == "") != (key == "") {
+		return fmt.Errorf("Both -tls-cert and -tls-key are needed for TLS.")
+	}
+	if cert == "" {
+		return nil
+	}
+	if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %s", err)
+	}
+	return nil
+}
+
+func sameCredentials(a, b []credential) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *serverState) setCredentials(creds []credential) {
+	s.mu.Lock()
+	s.creds = creds
+	s.mu.Unlock()
+}
+
+// authenticate returns the role of the client making r; the control role
+// when no credentials are configured, as before authentication was added
+func (s *serverState) authenticate(r *http.Request) (role string, ok bool) {
+	s.mu.RLock()
+	creds := s.creds
+	s.mu.RUnlock()
+	if creds == nil {
+		return roleControl, true
+	}
+
+	name, secret, basic := r.BasicAuth()
+	if !basic {
+		secret = r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			secret = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if secret == "" {
+		return "", false
+	}
+
+	// every credential is compared in constant time, so the time taken
+	// gives nothing away
+	for _, c := range creds {
+		match := subtle.ConstantTimeCompare([]byte(c.secret), []byte(secret)) == 1
+		if basic {
+			match = subtle.ConstantTimeCompare([]byte(c.name), []byte(name)) == 1 && match
+		}
+		if match && (role == "" || c.role == roleControl) {
+			role, ok = c.role, true
+		}
+	}
+	return
+}
+
+// authorize wraps the routes, letting listeners make GET requests, which
+// only look, and leaving any other request, which changes something, to
+// controllers
+func (s *serverState) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		role, ok := s.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="sdrctl"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && role != roleControl {
+			http.Error(w, "forbidden, listeners can't make changes", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
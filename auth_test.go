@@ -0,0 +1,178 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadCredentials(t *testing.T) {
+	tests := []struct {
+		text string
+		want []credential
+		// part of the error expected, if any
+		err string
+	}{
+		{"control alice horse\n", []credential{{roleControl, "alice", "horse"}}, ""},
+		{"# role name secret\n\n  listen\tpi-feed  6d1f  \ncontrol bob s3cret\n",
+			[]credential{{roleListen, "pi-feed", "6d1f"}, {roleControl, "bob", "s3cret"}}, ""},
+		{"listen pi-feed", nil, ":1: expected role, name and secret"},
+		{"# nobody\n", nil, "gives no credentials"},
+		{"", nil, "gives no credentials"},
+		{"control alice\n", nil, ":1: expected role, name and secret"},
+		{"control alice horse battery\n", nil, ":1: expected role, name and secret"},
+		{"# ok\nadmin alice horse\n", nil, ":2: role must be listen or control"},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		filename := filepath.Join(dir, "auth")
+		if err := os.WriteFile(filename, []byte(tt.text), 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadCredentials(filename)
+		if tt.err != "" || len(tt.want) == 0 {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("test %d: error '%v', want one containing '%s'", i, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test %d: %+v, '%v', want %+v", i, got, err, tt.want)
+		}
+	}
+
+	if _, err := loadCredentials(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file was loaded")
+	}
+}
+
+// authRequest is a request for path, with the credentials given by how
+func authRequest(method, path, how, name, secret string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	switch how {
+	case "basic":
+		r.SetBasicAuth(name, secret)
+	case "bearer":
+		r.Header.Set("Authorization", "Bearer "+secret)
+	case "token":
+		r.URL.RawQuery = "token=" + secret
+	}
+	return r
+}
+
+func TestAuthenticate(t *testing.T) {
+	creds := []credential{
+		{roleListen, "pi-feed", "listen-secret"},
+		{roleControl, "alice", "control-secret"},
+		// the same secret, under another name, for both roles
+		{roleListen, "shared", "shared-secret"},
+		{roleControl, "shared2", "shared-secret"},
+	}
+	tests := []struct {
+		creds        []credential
+		how          string
+		name, secret string
+		role         string
+		ok           bool
+	}{
+		{nil, "", "", "", roleControl, true},
+		{nil, "basic", "anyone", "anything", roleControl, true},
+		{creds, "", "", "", "", false},
+		{creds, "basic", "pi-feed", "listen-secret", roleListen, true},
+		{creds, "basic", "alice", "control-secret", roleControl, true},
+		{creds, "basic", "alice", "listen-secret", "", false},
+		{creds, "basic", "mallory", "control-secret", "", false},
+		{creds, "basic", "alice", "", "", false},
+		{creds, "bearer", "", "listen-secret", roleListen, true},
+		{creds, "bearer", "", "control-secret", roleControl, true},
+		{creds, "bearer", "", "wrong", "", false},
+		{creds, "token", "", "listen-secret", roleListen, true},
+		{creds, "token", "", "control-secret", roleControl, true},
+		{creds, "token", "", "", "", false},
+		// by the secret alone, control wins over listen
+		{creds, "bearer", "", "shared-secret", roleControl, true},
+		{creds, "token", "", "shared-secret", roleControl, true},
+		{creds, "basic", "shared", "shared-secret", roleListen, true},
+	}
+	for _, tt := range tests {
+		s := &serverState{}
+		s.setCredentials(tt.creds)
+		role, ok := s.authenticate(authRequest(http.MethodGet, "/status", tt.how, tt.name, tt.secret))
+		if role != tt.role || ok != tt.ok {
+			t.Errorf("%s %q/%q with %d credentials: %q, %t, want %q, %t",
+				tt.how, tt.name, tt.secret, len(tt.creds), role, ok, tt.role, tt.ok)
+		}
+	}
+
+	// a bearer token is taken over ?token=
+	s := &serverState{}
+	s.setCredentials(creds)
+	r := authRequest(http.MethodGet, "/status?token=control-secret", "bearer", "", "listen-secret")
+	if role, _ := s.authenticate(r); role != roleListen {
+		t.Errorf("bearer token and ?token= gave %q, want %q", role, roleListen)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	creds := []credential{
+		{roleListen, "pi-feed", "listen-secret"},
+		{roleControl, "alice", "control-secret"},
+	}
+	tests := []struct {
+		method string
+		secret string
+		status int
+	}{
+		{http.MethodGet, "", http.StatusUnauthorized},
+		{http.MethodGet, "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "", http.StatusUnauthorized},
+		{http.MethodGet, "listen-secret", http.StatusOK},
+		{http.MethodHead, "listen-secret", http.StatusOK},
+		{http.MethodPost, "listen-secret", http.StatusForbidden},
+		{http.MethodPut, "listen-secret", http.StatusForbidden},
+		{http.MethodDelete, "listen-secret", http.StatusForbidden},
+		{http.MethodGet, "control-secret", http.StatusOK},
+		{http.MethodPost, "control-secret", http.StatusOK},
+		{http.MethodDelete, "control-secret", http.StatusOK},
+	}
+	s := &serverState{}
+	s.setCredentials(creds)
+	h := s.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, authRequest(tt.method, "/tune", "bearer", "", tt.secret))
+		if w.Code != tt.status {
+			t.Errorf("%s with %q: status %d, want %d", tt.method, tt.secret, w.Code, tt.status)
+		}
+		if challenge := w.Header().Get("WWW-Authenticate"); (w.Code == http.StatusUnauthorized) != (challenge != "") {
+			t.Errorf("%s with %q: status %d, challenge %q", tt.method, tt.secret, w.Code, challenge)
+		}
+	}
+
+	// with no credentials configured, anyone may do anything
+	open := &serverState{}
+	h = open.authorize(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/tune", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("POST without credentials configured: status %d", w.Code)
+	}
+}
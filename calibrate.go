@@ -0,0 +1,120 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	calibrateRate = 1024000
+	calibrateBins = 1 << 16
+	calibrateFFTs = 16
+	// widest error searched for the reference carrier
+	calibrateMaxPPM = 150
+)
+
+// calibrate measures the dongle's frequency error against a carrier known to
+// be at ref Hz, returning the correction in ppm. The carrier is placed a
+// quarter of the sample rate above the centre frequency, clear of the DC
+// spike, and located by the peak of an averaged FFT.
+func calibrate(dev *rtl.Context, ref uint32) (ppm float64, err error) {
+	if err = dev.SetFreqCorrection(0); err != nil {
+		return
+	}
+	if err = dev.SetSampleRate(calibrateRate); err != nil {
+		return
+	}
+	center := int(ref) - calibrateRate/4
+	if err = dev.SetCenterFreq(center); err != nil {
+		return
+	}
+	if err = dev.ResetBuffer(); err != nil {
+		return
+	}
+
+	// discard samples captured whilst the tuner settles
+	dump := make([]byte, bufferDump)
+	if _, err = dev.ReadSync(dump, len(dump)); err != nil {
+		return
+	}
+
+	buf := make([]byte, 2*calibrateBins*calibrateFFTs)
+	if err = readFull(dev, buf); err != nil {
+		return
+	}
+
+	window := hannWindow(calibrateBins)
+	scratch := make([]complex128, calibrateBins)
+	acc := make([]float64, calibrateBins)
+	for i := 0; i < calibrateFFTs; i++ {
+		powerSpectrum(buf[2*calibrateBins*i:2*calibrateBins*(i+1)], window, scratch, acc)
+	}
+
+	binWidth := float64(calibrateRate) / calibrateBins
+	expected := calibrateBins/2 + calibrateBins/4
+	span := int(float64(ref) * calibrateMaxPPM / 1e6 / binWidth)
+	if span > calibrateBins/4-1 {
+		span = calibrateBins/4 - 1
+	}
+
+	offset, snr := locateCarrier(acc, expected, span, binWidth)
+	fmt.Fprintf(os.Stderr, "Reference carrier found %.1f Hz from %d Hz, %.1f dB above the noise\n",
+		offset, ref, snr)
+
+	ppm = offsetPPM(offset, center)
+	return
+}
+
+// locateCarrier finds the strongest bin of the power spectrum acc within span
+// bins of expected, returning its offset from there in Hz, interpolated
+// between bins, and its level above the noise in dB
+func locateCarrier(acc []float64, expected, span int, binWidth float64) (offset, snr float64) {
+	peak := expected - span
+	for i := expected - span; i <= expected+span; i++ {
+		if acc[i] > acc[peak] {
+			peak = i
+		}
+	}
+
+	// parabolic interpolation between the neighbouring bins
+	a, b, c := math.Log10(acc[peak-1]), math.Log10(acc[peak]), math.Log10(acc[peak+1])
+	delta := 0.0
+	if d := a - 2*b + c; d != 0 {
+		delta = 0.5 * (a - c) / d
+	}
+
+	offset = (float64(peak-expected) + delta) * binWidth
+	snr = 10 * (b - math.Log10(median(acc[expected-span:expected+span])))
+	return
+}
+
+// offsetPPM is the correction for a carrier seen offset Hz from where it
+// should be, tuned to center Hz. A fast crystal tunes high, so the carrier
+// appears low.
+func offsetPPM(offset float64, center int) float64 {
+	return -offset / float64(center) * 1e6
+}
+
+func median(vals []float64) float64 {
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	return sorted[len(sorted)/2]
+}
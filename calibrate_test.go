@@ -0,0 +1,77 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLocateCarrier(t *testing.T) {
+	const (
+		expected = 40
+		span     = 10
+		binWidth = 15.625
+	)
+	tests := []struct {
+		peak  float64 // in bins, may fall between them
+		other float64 // a stronger carrier outside the span, if non-zero
+		want  float64 // Hz
+	}{
+		{40, 0, 0},
+		{43, 0, 3 * binWidth},
+		{43.25, 0, 3.25 * binWidth},
+		{36.5, 0, -3.5 * binWidth},
+		{31.8, 0, -8.2 * binWidth},
+		{44.6, 55, 4.6 * binWidth},
+		{37, 22, -3 * binWidth},
+	}
+	for _, tt := range tests {
+		acc := make([]float64, 64)
+		for i := range acc {
+			// a Gaussian peak is a parabola in dB, 60 dB above the noise
+			acc[i] = 1 + 1e6*math.Pow(10, -math.Pow(float64(i)-tt.peak, 2)/2)
+			if tt.other != 0 {
+				acc[i] += 1e8 * math.Pow(10, -math.Pow(float64(i)-tt.other, 2)/2)
+			}
+		}
+		offset, snr := locateCarrier(acc, expected, span, binWidth)
+		if math.Abs(offset-tt.want) > 0.01*binWidth {
+			t.Errorf("carrier at bin %.2f: offset %.3f Hz, want %.3f Hz", tt.peak, offset, tt.want)
+		}
+		if tt.peak == math.Round(tt.peak) && math.Abs(snr-60) > 0.1 {
+			t.Errorf("carrier at bin %.2f: %.2f dB above the noise, want 60 dB", tt.peak, snr)
+		}
+	}
+}
+
+func TestOffsetPPM(t *testing.T) {
+	tests := []struct {
+		offset float64
+		center int
+		want   float64
+	}{
+		{0, 100000000, 0},
+		// a fast crystal tunes high, so the carrier appears low
+		{-1000, 100000000, 10},
+		{500, 50000000, -10},
+		{-25.5, 145000000, 25.5 / 145},
+	}
+	for _, tt := range tests {
+		if got := offsetPPM(tt.offset, tt.center); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("offsetPPM(%.1f, %d) = %.6f, want %.6f", tt.offset, tt.center, got, tt.want)
+		}
+	}
+}
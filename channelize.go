@@ -0,0 +1,292 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maximumRate = 2400000
+	// fraction of the capture bandwidth clear of the dongle's filter roll-off
+	usableBandwidth = 0.8
+)
+
+// channelizerState extracts every channel within the capture bandwidth,
+// demodulating them simultaneously rather than hopping between them
+type channelizerState struct {
+	enabled  bool
+	center   int
+	channels []*channelState
+}
+
+// channelState is a single channel of the channelizer, with its own mixer,
+// demodulator, squelch and output
+type channelState struct {
+	freq   uint32
+	mix    *mixer
+	demod  *demodState
+	output *outputState
+	pool   *bufferPool
+	iqChan chan *sharedBuffer
+}
+
+// setup chooses a capture rate and centre frequency covering as many of the
+// channels as possible, and tunes the dongle accordingly
+func (c *channelizerState) setup(r *Receiver) (err error) {
+	dongle, demod, controller := r.dongle, r.demod, r.controller
+
+	freqs := append(frequencies{}, controller.freqs...)
+	sort.Slice(freqs, func(i, j int) bool { return freqs[i] < freqs[j] })
+	lowest, highest := int(freqs[0]), int(freqs[len(freqs)-1])
+
+	downsample := (minimumRate / demod.rateIn) + 1
+	need := int(float64(highest-lowest+demod.rateIn) / usableBandwidth)
+	if need > downsample*demod.rateIn {
+		downsample = (need + demod.rateIn - 1) / demod.rateIn
+	}
+	if downsample*demod.rateIn > maximumRate {
+		downsample = maximumRate / demod.rateIn
+	}
+	rate := downsample * demod.rateIn
+	tuning := channelTuning(freqs, rate, demod.rateIn, dongle.tuning().preRotate)
+	c.center = int(tuning.center())
+
+	demod.downsample = downsample
+	demod.outputScale = (1 << 15) / (128 * downsample)
+	if demod.outputScale < 1 {
+		demod.outputScale = 1
+	}
+	if reflect.ValueOf(demod.modeDemod).Pointer() == reflect.ValueOf(fmDemod).Pointer() {
+		demod.outputScale = 1
+	}
+	squelchLevel := squelchToRms(demod.squelchLevel, dongle, demod)
+
+	for _, freq := range freqs {
+		if !tuning.reaches(freq, demod.rateIn) {
+			r.logf("Channel %d Hz is outside the capture bandwidth, or on its DC spike, ignoring\n", controller.userFreq(freq))
+			continue
+		}
+		// offset from the centre of the rotated capture, which may be over
+		// half the rate, as the mixer wraps
+		offset := int(freq) - c.center
+
+		d := *demod
+		d.squelchLevel = squelchLevel
+
+		o := &outputState{
+			filename:   channelFilename(r.output.filename, controller.userFreq(freq)),
+			rate:       r.output.rate,
+			pad:        r.output.pad,
+			codec:      r.output.codec,
+			bitrate:    r.output.bitrate,
+			logf:       r.logf,
+			resultChan: make(chan audioChunk, 1),
+		}
+		o.pool = newBufferPool(cap(o.resultChan) + 2)
+		o.file, err = os.Create(o.filename)
+		if err != nil {
+			return
+		}
+		if err = o.begin(); err != nil {
+			o.close()
+			return
+		}
+
+		c.channels = append(c.channels, &channelState{
+			freq:   freq,
+			mix:    newMixer(-offset, rate),
+			demod:  &d,
+			output: o,
+			pool:   newBufferPool(3),
+			iqChan: make(chan *sharedBuffer, 1),
+		})
+		r.logf("Channel %d Hz at offset %d Hz, writing to %s\n", controller.userFreq(freq), offset, o.filename)
+	}
+
+	dongle.setTuning(tuning.freq, tuning.rate)
+
+	err = dongle.setCenterFreq()
+	if err != nil {
+		return fmt.Errorf("Error setting frequency %d", dongle.freq)
+	}
+	err = dongle.dev.SetSampleRate(int(dongle.rate))
+	if err != nil {
+		return fmt.Errorf("Error setting sample rate %d", dongle.rate)
+	}
+	r.logf("Tuned to %d Hz.\n", dongle.freq)
+	r.logf("Sampling at %d S/s.\n", dongle.rate)
+	return
+}
+
+// channelTuning chooses the frequency to tune the dongle to for capturing
+// freqs, sorted, at rate: centred on them, or covering as many from the
+// lowest as it can, but moved aside or into a gap between channels should
+// that put fewer of them out of reach.
+func channelTuning(freqs frequencies, rate, bandwidth int, preRotate bool) dongleTuning {
+	lowest, highest := int(freqs[0]), int(freqs[len(freqs)-1])
+	usable := int(float64(rate)*usableBandwidth) - bandwidth
+	center := (lowest + highest) / 2
+	if highest-lowest > usable {
+		center = lowest + usable/2
+	}
+
+	reached := func(t dongleTuning) (n int) {
+		for _, freq := range freqs {
+			if t.reaches(freq, bandwidth) {
+				n++
+			}
+		}
+		return
+	}
+	distance := func(t dongleTuning) int {
+		if d := int(t.freq) - center; d > 0 {
+			return d
+		}
+		return center - int(t.freq)
+	}
+
+	best := dongleTuning{freq: uint32(center), rate: uint32(rate), preRotate: preRotate}
+	if !preRotate {
+		return best
+	}
+	// the spike may otherwise be moved just aside, when that's enough
+	candidates := []uint32{uint32(center - bandwidth), uint32(center + bandwidth)}
+	for i := 1; i < len(freqs); i++ {
+		candidates = append(candidates, freqs[i-1]+(freqs[i]-freqs[i-1])/2)
+	}
+	most := reached(best)
+	for _, freq := range candidates {
+		t := best
+		t.freq = freq
+		n := reached(t)
+		if n > most || n == most && distance(t) < distance(best) {
+			best, most = t, n
+		}
+	}
+	return best
+}
+
+// channelFilename derives a channel's output file from the one given on the
+// command line; either substituting the frequency for %d, or inserting it
+// before the extension.
+func channelFilename(name string, freq uint32) string {
+	if strings.Contains(name, "%d") {
+		return fmt.Sprintf(name, freq)
+	}
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), freq, ext)
+}
+
+// channelizerRoutine takes the place of controllerRoutine and demodRoutine,
+// handing each buffer from the dongle to every channel.
+func (r *Receiver) channelizerRoutine(wg *sync.WaitGroup) {
+	var channelWg sync.WaitGroup
+
+	defer wg.Done()
+
+	c := r.channelizer
+
+	err := c.setup(r)
+	for _, ch := range c.channels {
+		defer ch.output.close()
+	}
+	if err != nil {
+		r.logf("%s, stopping\n", err)
+		r.stop()
+		return
+	}
+
+	for _, ch := range c.channels {
+		channelWg.Add(2)
+		go r.channelRoutine(&channelWg, ch)
+		go outputRoutine(&channelWg, ch.output)
+	}
+
+	for buf := range r.dongle.lpChan {
+		shared := &sharedBuffer{refs: int32(len(c.channels)), buf: buf, pool: r.dongle.pool}
+		for _, ch := range c.channels {
+			select {
+			case ch.iqChan <- shared:
+			case <-r.ctx.Done():
+				shared.release()
+			}
+		}
+	}
+
+	for _, ch := range c.channels {
+		close(ch.iqChan)
+	}
+	channelWg.Wait()
+
+	r.logf("Returning from channelizerRoutine\n")
+}
+
+// channelRoutine shifts the channel to baseband and demodulates it; buffers
+// received are shared between channels, so must not be modified, and are
+// released once mixed.
+func (r *Receiver) channelRoutine(wg *sync.WaitGroup, ch *channelState) {
+	defer wg.Done()
+
+	d := ch.demod
+	squelched := true
+	frames := r.pipeline(wg, d, ch.output)
+	defer func() {
+		if frames != nil {
+			close(frames)
+		} else {
+			close(ch.output.resultChan)
+		}
+	}()
+
+	for shared := range ch.iqChan {
+		buf := ch.pool.get(len(shared.buf))
+		ch.mix.mix(shared.buf, buf)
+		shared.release()
+		d.lowpassed = buf
+
+		start := time.Now()
+		resetAGC := d.frontEnd()
+		f := demodFrame{
+			buf:      buf,
+			pool:     ch.pool,
+			samples:  d.lowpassed,
+			settings: d.backEndSettings(),
+			resetAGC: resetAGC,
+			output:   true,
+			freq:     r.controller.userFreq(ch.freq),
+			took:     time.Since(start),
+			open:     d.squelchLevel == 0 || d.squelchHits == 0,
+		}
+		if d.squelchLevel > 0 && d.squelchHits > d.conseqSquelch {
+			d.squelchHits = d.conseqSquelch + 1
+			f.output = false
+			squelched = true
+		} else if d.squelchLevel > 0 && squelched && d.squelchHits == 0 {
+			squelched = false
+			f.onset = true
+		}
+		if !r.handOff(frames, d, f, ch.output) {
+			return
+		}
+	}
+}
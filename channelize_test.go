@@ -0,0 +1,107 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import "testing"
+
+func TestChannelFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		freq uint32
+		want string
+	}{
+		{"pmr-%d.raw", 446006250, "pmr-446006250.raw"},
+		{"%d", 145500000, "145500000"},
+		{"out.raw", 446006250, "out.446006250.raw"},
+		{"out", 446006250, "out.446006250"},
+		{"rec/scan.wav", 145500000, "rec/scan.145500000.wav"},
+		{"rec.d/scan", 145500000, "rec.d/scan.145500000"},
+		{"a.b.raw", 145500000, "a.b.145500000.raw"},
+	}
+	for _, tt := range tests {
+		if got := channelFilename(tt.name, tt.freq); got != tt.want {
+			t.Errorf("channelFilename(%q, %d) = %q, want %q", tt.name, tt.freq, got, tt.want)
+		}
+	}
+}
+
+func TestChannelTuning(t *testing.T) {
+	tests := []struct {
+		freqs     frequencies
+		preRotate bool
+		want      uint32
+		reached   int
+	}{
+		// centred, but for the middle channel being on the DC spike
+		{frequencies{145000000, 145500000, 146000000}, true, 145476000, 3},
+		// too tight to move aside, into the gap
+		{frequencies{145000000, 145476000, 145500000, 145524000, 146000000}, true, 145238000, 5},
+		{frequencies{145000000, 145500000, 146000000}, false, 145500000, 3},
+		{frequencies{145000000, 145400000, 146000000}, true, 145500000, 3},
+		// more than can be covered, from the lowest
+		{frequencies{145000000, 145500000, 147000000}, true, 145948000, 2},
+		// moved aside from a single channel
+		{frequencies{145500000}, true, 145476000, 1},
+	}
+	for _, tt := range tests {
+		got := channelTuning(tt.freqs, 2400000, 24000, tt.preRotate)
+		if got.freq != tt.want || got.rate != 2400000 || got.preRotate != tt.preRotate {
+			t.Errorf("channelTuning(%v, %t) = %+v, want %d Hz", tt.freqs, tt.preRotate, got, tt.want)
+		}
+		reached := 0
+		for _, freq := range tt.freqs {
+			if got.reaches(freq, 24000) {
+				reached++
+			}
+		}
+		if reached != tt.reached {
+			t.Errorf("channelTuning(%v, %t) reaches %d channels, want %d", tt.freqs, tt.preRotate, reached, tt.reached)
+		}
+	}
+}
+
+func TestLowPassFullScale(t *testing.T) {
+	tests := []struct {
+		downsample int
+		shift      uint
+	}{
+		{42, 0},
+		{180, 0},
+		// as the channelizer reaches at narrow rates, scaled to fit
+		{181, 1},
+		{300, 1},
+		{400, 2},
+	}
+	for _, tt := range tests {
+		d := &demodState{downsample: tt.downsample}
+		d.lowpassed = make([]int16, 4*tt.downsample)
+		for i := range d.lowpassed {
+			// a full scale sample rotated by the mixer
+			d.lowpassed[i] = 181
+			if i%2 == 1 {
+				d.lowpassed[i] = -181
+			}
+		}
+		lowPass(d)
+		if len(d.lowpassed) != 4 {
+			t.Fatalf("downsample %d: %d samples out, want 4", tt.downsample, len(d.lowpassed))
+		}
+		wantR, wantJ := int16(tt.downsample*181>>tt.shift), int16(-tt.downsample*181>>tt.shift)
+		if d.lowpassed[0] != wantR || d.lowpassed[1] != wantJ {
+			t.Errorf("downsample %d: lowpassed to %d, %d, want %d, %d",
+				tt.downsample, d.lowpassed[0], d.lowpassed[1], wantR, wantJ)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	codecPCM   = "pcm"
+	codecADPCM = "adpcm"
+	codecOpus  = "opus"
+
+	// bytes per IMA ADPCM block: a 4 byte header holding the first sample and
+	// step index, then two samples to a byte
+	adpcmBlockAlign   = 256
+	adpcmBlockSamples = (adpcmBlockAlign-4)*2 + 1
+
+	// sizes given in the header of a WAV file of unknown length, whilst it's
+	// being written or streamed
+	wavStreaming = 0xffffffff
+)
+
+var imaIndexTable = [16]int{-1, -1, -1, -1, 2, 4, 6, 8, -1, -1, -1, -1, 2, 4, 6, 8}
+
+var imaStepTable = [89]int{
+	7, 8, 9, 10, 11, 12, 13, 14, 16, 17, 19, 21, 23, 25, 28, 31, 34, 37, 41,
+	45, 50, 55, 60, 66, 73, 80, 88, 97, 107, 118, 130, 143, 157, 173, 190, 209,
+	230, 253, 279, 307, 337, 371, 408, 449, 494, 544, 598, 658, 724, 796, 876,
+	963, 1060, 1166, 1282, 1411, 1552, 1707, 1878, 2066, 2272, 2499, 2749,
+	3024, 3327, 3660, 4026, 4428, 4871, 5358, 5894, 6484, 7132, 7845, 8630,
+	9493, 10442, 11487, 12635, 13899, 15289, 16818, 18500, 20350, 22385, 24623,
+	27086, 29794, 32767,
+}
+
+// encoder turns audio into the bytes of a codec, appending them to dst.
+// Codecs working in blocks hold samples back until a block is complete; sync
+// writes out what's held whilst a stream pauses, and flush pads out the last
+// block and ends the stream.
+type encoder interface {
+	encode(dst []byte, buf []int16) []byte
+	sync(dst []byte) []byte
+	flush(dst []byte) []byte
+}
+
+// newEncoder encodes audio at rate; only Opus takes a bitrate, the others
+// meeting one by lowering the rate, and only Opus may fail to code audio,
+// reporting the packets it drops to logf
+func newEncoder(codec string, rate, bitrate int, logf func(format string, a ...interface{})) (encoder, error) {
+	switch codec {
+	case codecPCM:
+		return pcmEncoder{}, nil
+	case codecADPCM:
+		return &adpcmEncoder{pending: make([]int16, 0, adpcmBlockSamples)}, nil
+	case codecOpus:
+		e, err := newOggOpusEncoder(rate, bitrate, logf)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("Codec must be %s, %s or %s.", codecPCM, codecADPCM, codecOpus)
+}
+
+// defaultBitrate of codec at rate, when none is asked for
+func defaultBitrate(codec string, rate int) int {
+	if codec == codecOpus {
+		return opusDefaultBitrate
+	}
+	return rate * bitsPerSample(codec)
+}
+
+// bitsPerSample of each codec, for choosing a rate to meet a bitrate
+func bitsPerSample(codec string) int {
+	if codec == codecADPCM {
+		return 4
+	}
+	return 16
+}
+
+// pcmEncoder writes 16 bit little endian samples, as sdrctl always has
+type pcmEncoder struct{}
+
+func (pcmEncoder) encode(dst []byte, buf []int16) []byte {
+	for _, s := range buf {
+		dst = append(dst, byte(s), byte(s>>8))
+	}
+	return dst
+}
+
+func (pcmEncoder) sync(dst []byte) []byte {
+	return dst
+}
+
+func (pcmEncoder) flush(dst []byte) []byte {
+	return dst
+}
+
+// adpcmEncoder writes IMA ADPCM, as used in WAV files: a quarter the size of
+// PCM, simple enough for a Pi Zero to encode several streams, and decoded by
+// most players. Each block starts afresh from its header, so a listener can
+// join a stream at any block, and a lost block costs only itself.
+type adpcmEncoder struct {
+	predictor int
+	index     int
+	pending   []int16
+}
+
+func (e *adpcmEncoder) encode(dst []byte, buf []int16) []byte {
+	for len(buf) > 0 {
+		n := adpcmBlockSamples - len(e.pending)
+		if n > len(buf) {
+			n = len(buf)
+		}
+		e.pending = append(e.pending, buf[:n]...)
+		buf = buf[n:]
+		if len(e.pending) == adpcmBlockSamples {
+			dst = e.block(dst)
+		}
+	}
+	return dst
+}
+
+func (e *adpcmEncoder) sync(dst []byte) []byte {
+	return e.flush(dst)
+}
+
+func (e *adpcmEncoder) flush(dst []byte) []byte {
+	if len(e.pending) == 0 {
+		return dst
+	}
+	for len(e.pending) < adpcmBlockSamples {
+		e.pending = append(e.pending, 0)
+	}
+	return e.block(dst)
+}
+
+// block encodes a whole block of pending samples
+func (e *adpcmEncoder) block(dst []byte) []byte {
+	p := e.pending
+	e.predictor = int(p[0])
+	dst = append(dst, byte(p[0]), byte(p[0]>>8), byte(e.index), 0)
+	for i := 1; i < len(p); i += 2 {
+		lo := e.nibble(p[i])
+		hi := e.nibble(p[i+1])
+		dst = append(dst, lo|hi<<4)
+	}
+	e.pending = e.pending[:0]
+	return dst
+}
+
+// nibble quantises the difference between sample and the prediction to four
+// bits, adapting the step size to suit
+func (e *adpcmEncoder) nibble(sample int16) (n byte) {
+	step := imaStepTable[e.index]
+	diff := int(sample) - e.predictor
+	if diff < 0 {
+		n = 8
+		diff = -diff
+	}
+
+	delta := step >> 3
+	if diff >= step {
+		n |= 4
+		diff -= step
+		delta += step
+	}
+	step >>= 1
+	if diff >= step {
+		n |= 2
+		diff -= step
+		delta += step
+	}
+	step >>= 1
+	if diff >= step {
+		n |= 1
+		delta += step
+	}
+
+	if n&8 != 0 {
+		e.predictor -= delta
+	} else {
+		e.predictor += delta
+	}
+	if e.predictor > 32767 {
+		e.predictor = 32767
+	} else if e.predictor < -32768 {
+		e.predictor = -32768
+	}
+
+	e.index += imaIndexTable[n]
+	if e.index < 0 {
+		e.index = 0
+	} else if e.index > len(imaStepTable)-1 {
+		e.index = len(imaStepTable) - 1
+	}
+	return
+}
+
+// wavHeader returns the header of a mono WAV file of the codec at rate,
+// holding dataLen bytes of samples
+func wavHeader(codec string, rate int, dataLen, samples uint32) []byte {
+	le := binary.LittleEndian
+	fmtLen, factLen := 16, 0
+	if codec == codecADPCM {
+		// the samples per block follow the usual fields, and compressed
+		// formats give the number of samples in a fact chunk
+		fmtLen, factLen = 20, 12
+	}
+
+	h := make([]byte, 12+8+fmtLen+factLen+8)
+	copy(h[0:], "RIFF")
+	riffLen := uint32(len(h)-8) + dataLen
+	if dataLen == wavStreaming {
+		riffLen = wavStreaming
+	}
+	le.PutUint32(h[4:], riffLen)
+	copy(h[8:], "WAVE")
+
+	f := h[12:]
+	copy(f, "fmt ")
+	le.PutUint32(f[4:], uint32(fmtLen))
+	if codec == codecADPCM {
+		le.PutUint16(f[8:], 0x11)
+		le.PutUint16(f[10:], 1)
+		le.PutUint32(f[12:], uint32(rate))
+		le.PutUint32(f[16:], uint32(rate*adpcmBlockAlign/adpcmBlockSamples))
+		le.PutUint16(f[20:], adpcmBlockAlign)
+		le.PutUint16(f[22:], 4)
+		le.PutUint16(f[24:], 2)
+		le.PutUint16(f[26:], adpcmBlockSamples)
+
+		fact := f[8+fmtLen:]
+		copy(fact, "fact")
+		le.PutUint32(fact[4:], 4)
+		le.PutUint32(fact[8:], samples)
+	} else {
+		le.PutUint16(f[8:], 1)
+		le.PutUint16(f[10:], 1)
+		le.PutUint32(f[12:], uint32(rate))
+		le.PutUint32(f[16:], uint32(rate*2))
+		le.PutUint16(f[20:], 2)
+		le.PutUint16(f[22:], 16)
+	}
+
+	d := h[len(h)-8:]
+	copy(d, "data")
+	le.PutUint32(d[4:], dataLen)
+	return h
+}
+
+// segment is the G.711 segment of a magnitude, given the ends of each
+func segment(val int, ends *[8]int) int {
+	for i, end := range ends {
+		if val <= end {
+			return i
+		}
+	}
+	return len(ends)
+}
+
+var (
+	alawSegmentEnds = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+	ulawSegmentEnds = [8]int{0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff, 0x1fff}
+)
+
+// linearToALaw encodes a sample as G.711 A-law (PCMA)
+func linearToALaw(sample int16) byte {
+	val := int(sample) >> 3
+	mask := byte(0xd5)
+	if val < 0 {
+		mask = 0x55
+		val = -val - 1
+	}
+
+	seg := segment(val, &alawSegmentEnds)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	aval := byte(seg << 4)
+	if seg < 2 {
+		aval |= byte(val>>1) & 0xf
+	} else {
+		aval |= byte(val>>uint(seg)) & 0xf
+	}
+	return aval ^ mask
+}
+
+// linearToULaw encodes a sample as G.711 µ-law (PCMU)
+func linearToULaw(sample int16) byte {
+	const bias, clip = 0x21, 8159
+
+	val := int(sample) >> 2
+	mask := byte(0xff)
+	if val < 0 {
+		mask = 0x7f
+		val = -val
+	}
+	if val > clip {
+		val = clip
+	}
+	val += bias
+
+	seg := segment(val, &ulawSegmentEnds)
+	if seg >= 8 {
+		return 0x7f ^ mask
+	}
+	return byte(seg<<4|(val>>uint(seg+1))&0xf) ^ mask
+}
@@ -0,0 +1,254 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// decodeADPCM is the usual IMA ADPCM decoder of WAV files
+func decodeADPCM(block []byte) (out []int16) {
+	pred := int(int16(binary.LittleEndian.Uint16(block)))
+	index := int(block[2])
+	out = append(out, int16(pred))
+	for _, b := range block[4:] {
+		for _, n := range []byte{b & 0xf, b >> 4} {
+			step := imaStepTable[index]
+			diff := step >> 3
+			if n&4 != 0 {
+				diff += step
+			}
+			if n&2 != 0 {
+				diff += step >> 1
+			}
+			if n&1 != 0 {
+				diff += step >> 2
+			}
+			if n&8 != 0 {
+				pred -= diff
+			} else {
+				pred += diff
+			}
+			if pred > math.MaxInt16 {
+				pred = math.MaxInt16
+			} else if pred < math.MinInt16 {
+				pred = math.MinInt16
+			}
+			index += imaIndexTable[n]
+			if index < 0 {
+				index = 0
+			} else if index > len(imaStepTable)-1 {
+				index = len(imaStepTable) - 1
+			}
+			out = append(out, int16(pred))
+		}
+	}
+	return
+}
+
+func TestADPCM(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples int
+		freq    float64
+		amp     float64
+		// blocks written, and the least signal to noise ratio in dB
+		blocks int
+		snr    float64
+	}{
+		{"silence", 3 * adpcmBlockSamples, 300, 0, 3, 0},
+		{"tone", 3 * adpcmBlockSamples, 300, 10000, 3, 20},
+		{"loud", 2 * adpcmBlockSamples, 1000, 32000, 2, 15},
+		{"part block", adpcmBlockSamples + 10, 700, 8000, 2, 15},
+		{"one sample", 1, 700, 8000, 1, 0},
+	}
+	for _, tt := range tests {
+		pcm := make([]int16, tt.samples)
+		for i := range pcm {
+			pcm[i] = int16(tt.amp * math.Sin(2*math.Pi*tt.freq*float64(i)/8000))
+		}
+		enc, _ := newEncoder(codecADPCM, 8000, 0, t.Logf)
+		var b []byte
+		for i := 0; i < len(pcm); i += 100 {
+			b = enc.encode(b, pcm[i:minInt(i+100, len(pcm))])
+		}
+		b = enc.flush(b)
+		if len(b) != tt.blocks*adpcmBlockAlign {
+			t.Fatalf("%s: %d bytes, want %d blocks", tt.name, len(b), tt.blocks)
+		}
+
+		var out []int16
+		for i := 0; i < len(b); i += adpcmBlockAlign {
+			block := b[i : i+adpcmBlockAlign]
+			if block[3] != 0 {
+				t.Errorf("%s: block %d has reserved byte %d", tt.name, i/adpcmBlockAlign, block[3])
+			}
+			out = append(out, decodeADPCM(block)...)
+		}
+		signal, noise := 0.0, 0.0
+		for i, s := range pcm {
+			d := float64(out[i]) - float64(s)
+			signal += float64(s) * float64(s)
+			noise += d * d
+		}
+		for _, s := range out[len(pcm):] {
+			noise += float64(s) * float64(s)
+		}
+		if tt.amp == 0 {
+			if noise != 0 {
+				t.Errorf("%s: decoded with noise %g", tt.name, noise)
+			}
+		} else if snr := 10 * math.Log10(signal/noise); snr < tt.snr {
+			t.Errorf("%s: signal to noise %.1fdB, want at least %.0fdB", tt.name, snr, tt.snr)
+		}
+	}
+}
+
+// the G.711 decoders of the reference implementation
+func alawToLinear(a byte) int {
+	a ^= 0x55
+	t := int(a&0xf) << 4
+	switch seg := int(a&0x70) >> 4; seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t = (t + 0x108) << uint(seg-1)
+	}
+	if a&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+func ulawToLinear(u byte) int {
+	u = ^u
+	t := (int(u&0xf)<<3 + 0x84) << (uint(u&0x70) >> 4)
+	if u&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
+
+func TestG711(t *testing.T) {
+	tests := []struct {
+		sample     int16
+		alaw, ulaw byte
+	}{
+		{0, 0xd5, 0xff},
+		{-1, 0x55, 0x7e},
+		{8, 0xd5, 0xfe},
+		{1000, 0xfa, 0xce},
+		{-1000, 0x7a, 0x4e},
+		{math.MaxInt16, 0xaa, 0x80},
+		{math.MinInt16, 0x2a, 0x00},
+	}
+	for _, tt := range tests {
+		if got := linearToALaw(tt.sample); got != tt.alaw {
+			t.Errorf("linearToALaw(%d) = %#x, want %#x", tt.sample, got, tt.alaw)
+		}
+		if got := linearToULaw(tt.sample); got != tt.ulaw {
+			t.Errorf("linearToULaw(%d) = %#x, want %#x", tt.sample, got, tt.ulaw)
+		}
+	}
+
+	// every sample decodes to within half a step, about 1/32 of its size
+	for s := -32000; s <= 32000; s++ {
+		bound := absInt(s)/16 + 16
+		if d := alawToLinear(linearToALaw(int16(s))); absInt(d-s) > bound {
+			t.Fatalf("%d A-law decodes as %d", s, d)
+		}
+		if d := ulawToLinear(linearToULaw(int16(s))); absInt(d-s) > bound {
+			t.Fatalf("%d µ-law decodes as %d", s, d)
+		}
+	}
+}
+
+func TestWavHeader(t *testing.T) {
+	le := binary.LittleEndian
+	tests := []struct {
+		codec            string
+		rate             int
+		dataLen, samples uint32
+		// the length of the header, its RIFF size, and fmt fields
+		len         int
+		riff        uint32
+		format      uint16
+		byteRate    uint32
+		align, bits uint16
+	}{
+		{codecPCM, 8000, 1000, 500, 44, 1036, 1, 16000, 2, 16},
+		{codecPCM, 24000, wavStreaming, 0, 44, wavStreaming, 1, 48000, 2, 16},
+		{codecADPCM, 8000, 2560, 5050, 60, 2612, 0x11, 4055, adpcmBlockAlign, 4},
+		{codecADPCM, 22050, wavStreaming, 0, 60, wavStreaming, 0x11, 11177, adpcmBlockAlign, 4},
+	}
+	for _, tt := range tests {
+		h := wavHeader(tt.codec, tt.rate, tt.dataLen, tt.samples)
+		if len(h) != tt.len {
+			t.Fatalf("%s header of %d bytes, want %d", tt.codec, len(h), tt.len)
+		}
+		if string(h[0:4]) != "RIFF" || string(h[8:12]) != "WAVE" || string(h[12:16]) != "fmt " {
+			t.Errorf("%s header starts %q", tt.codec, h[:16])
+		}
+		if got := le.Uint32(h[4:]); got != tt.riff {
+			t.Errorf("%s RIFF size %d, want %d", tt.codec, got, tt.riff)
+		}
+		if le.Uint16(h[20:]) != tt.format || le.Uint16(h[22:]) != 1 || le.Uint32(h[24:]) != uint32(tt.rate) ||
+			le.Uint32(h[28:]) != tt.byteRate || le.Uint16(h[32:]) != tt.align || le.Uint16(h[34:]) != tt.bits {
+			t.Errorf("%s fmt chunk %x", tt.codec, h[12:tt.len-8])
+		}
+		if tt.codec == codecADPCM {
+			if le.Uint16(h[38:]) != adpcmBlockSamples || string(h[40:44]) != "fact" || le.Uint32(h[48:]) != tt.samples {
+				t.Errorf("adpcm fmt extension and fact chunk %x", h[36:52])
+			}
+		}
+		d := h[tt.len-8:]
+		if string(d[:4]) != "data" || le.Uint32(d[4:]) != tt.dataLen {
+			t.Errorf("%s data chunk %x", tt.codec, d)
+		}
+	}
+}
+
+func TestRateFactor(t *testing.T) {
+	tests := []struct {
+		rate    int
+		codec   string
+		bitrate int
+		want    int
+	}{
+		{24000, codecADPCM, 96000, 1},
+		{24000, codecADPCM, 32000, 3},
+		{24000, codecPCM, 384000, 1},
+		{24000, codecPCM, 64000, 6},
+		{22050, codecADPCM, 20000, 5},
+		{24000, codecADPCM, 16000, 6},
+		{24000, codecPCM, 32000, 0},
+		{8000, codecADPCM, 15999, 0},
+		{24000, codecOpus, 6000, 1},
+	}
+	for _, tt := range tests {
+		got, err := rateFactor(tt.rate, tt.codec, tt.bitrate)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("rateFactor(%d, %s, %d) = %d, want an error", tt.rate, tt.codec, tt.bitrate, got)
+			}
+		} else if err != nil || got != tt.want {
+			t.Errorf("rateFactor(%d, %s, %d) = %d, %v, want %d", tt.rate, tt.codec, tt.bitrate, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The configuration file is a subset of TOML: process settings at the top
+// level, followed by a [[receiver]] table per receiver. Keys are the flags
+// they stand in for, with underscores in place of hyphens, or the longer
+// names in configKeys. Values are strings, numbers, booleans or arrays of
+// them, the latter for settings which may be given more than once e.g
+//
+//	http = ":8080"
+//
+//	[[receiver]]
+//	name = "roof"
+//	device = "ROOF"
+//	frequencies = ["145.5M", "145.6M:145.8M:12.5k"]
+//	squelch = 20
+//	mode = "fm"
+//	output = "roof.raw"
+
+// configKeys maps keys onto the flags they set, where they aren't simply
+// the flag's name
+var configKeys = map[string]string{
+	"device":          "d",
+	"frequencies":     "f",
+	"squelch":         "l",
+	"sample_rate":     "s",
+	"ppm":             "p",
+	"direct_sampling": "direct",
+	"gain":            "g",
+	"mode":            "M",
+}
+
+// configGlobal are the flags set at the top level of the file, rather than
+// per receiver
+var configGlobal = map[string]bool{
+	"http":             true,
+	"shutdown-timeout": true,
+	"tls-cert":         true,
+	"tls-key":          true,
+	"auth":             true,
+}
+
+// configValue holds a value as it would be given to the flag, or each
+// element of an array
+type configValue struct {
+	vals  []string
+	array bool
+	line  int
+}
+
+type configSection map[string]configValue
+
+type configFile struct {
+	filename  string
+	global    configSection
+	receivers []configSection
+}
+
+func loadConfig(filename string) (c *configFile, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	c = &configFile{filename: filename, global: configSection{}}
+	section := c.global
+
+	var pending string
+	var start int
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if pending != "" {
+			// continuing a multi-line array
+			line = pending + " " + line
+			if !balanced(line) {
+				pending = line
+				continue
+			}
+			pending = ""
+		} else {
+			start = n
+		}
+		if line == "" {
+			continue
+		}
+
+		switch {
+		case line == "[[receiver]]":
+			section = configSection{}
+			c.receivers = append(c.receivers, section)
+			continue
+		case strings.HasPrefix(line, "["):
+			return nil, fmt.Errorf("%s:%d: unknown table %s", filename, n, line)
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", filename, start)
+		}
+		key := strings.TrimSpace(line[:eq])
+		text := strings.TrimSpace(line[eq+1:])
+		if !balanced(text) {
+			pending = line
+			continue
+		}
+
+		if _, ok := section[key]; ok {
+			return nil, fmt.Errorf("%s:%d: %s given more than once", filename, start, key)
+		}
+		v, err := parseConfigValue(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, start, err)
+		}
+		v.line = start
+		section[key] = v
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if pending != "" {
+		return nil, fmt.Errorf("%s:%d: unterminated array", filename, start)
+	}
+	return
+}
+
+// stripComment removes a trailing comment, ignoring # within strings
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// balanced reports whether every [ in s, outside of strings, is closed
+func balanced(s string) bool {
+	var quote byte
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// splitOutsideQuotes splits s at each sep which isn't within a string
+func splitOutsideQuotes(s string, sep byte) (items []string) {
+	var quote byte
+	last := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == sep:
+			items = append(items, s[last:i])
+			last = i + 1
+		}
+	}
+	return append(items, s[last:])
+}
+
+func parseConfigValue(text string) (v configValue, err error) {
+	if !strings.HasPrefix(text, "[") {
+		var val string
+		val, err = parseConfigScalar(text)
+		v.vals = []string{val}
+		return
+	}
+
+	if !strings.HasSuffix(text, "]") {
+		return v, fmt.Errorf("malformed array %s", text)
+	}
+	v.array = true
+	for _, item := range splitOutsideQuotes(text[1:len(text)-1], ',') {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			// permit a trailing comma
+			continue
+		}
+		if strings.HasPrefix(item, "[") {
+			return v, fmt.Errorf("nested arrays aren't supported")
+		}
+		val, err := parseConfigScalar(item)
+		if err != nil {
+			return v, err
+		}
+		v.vals = append(v.vals, val)
+	}
+	return
+}
+
+func parseConfigScalar(text string) (val string, err error) {
+	switch {
+	case strings.HasPrefix(text, `"`):
+		if val, err = strconv.Unquote(text); err != nil {
+			return "", fmt.Errorf("invalid string %s", text)
+		}
+		return
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return "", fmt.Errorf("unterminated string %s", text)
+		}
+		return text[1 : len(text)-1], nil
+	case text == "true" || text == "false":
+		return text, nil
+	}
+
+	val = strings.ReplaceAll(text, "_", "")
+	if _, err = strconv.ParseFloat(val, 64); err != nil {
+		return "", fmt.Errorf("invalid value %s", text)
+	}
+	return
+}
+
+// apply sets the flags of fs which weren't given on the command line from
+// the section, returning the output file if it's named here.
+func (s configSection) apply(fs *flag.FlagSet, filename string, global bool) (output string, err error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v := s[key]
+		if key == "output" && !global {
+			if v.array {
+				return "", fmt.Errorf("%s:%d: output takes a single value", filename, v.line)
+			}
+			output = v.vals[0]
+			continue
+		}
+
+		name, ok := configKeys[key]
+		if !ok {
+			name = strings.ReplaceAll(key, "_", "-")
+		}
+		f := fs.Lookup(name)
+		if f == nil || configGlobal[name] != global {
+			return "", fmt.Errorf("%s:%d: unknown setting %s", filename, v.line, key)
+		}
+		if given[name] {
+			continue
+		}
+		if _, list := f.Value.(*frequencies); v.array && !list {
+			return "", fmt.Errorf("%s:%d: %s takes a single value", filename, v.line, key)
+		}
+		for _, val := range v.vals {
+			if err = fs.Set(name, val); err != nil {
+				return "", fmt.Errorf("%s:%d: invalid value for %s: %s", filename, v.line, key, err)
+			}
+		}
+	}
+	return
+}
+
+// settings records the value of each of the receiver's flags once
+// configured, for reload to compare against
+func (r *Receiver) snapshot(fs *flag.FlagSet) {
+	r.settings = make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !processFlags[f.Name] {
+			r.settings[f.Name] = f.Value.String()
+		}
+	})
+	r.settings["output"] = r.output.filename
+}
+
+// liveSettings are those which reload can change on a running receiver,
+// the rest require a restart
+var liveSettings = map[string]func(r, next *Receiver) error{
+	"g":             (*Receiver).reloadGain,
+	"p":             (*Receiver).reloadPPM,
+	"f":             (*Receiver).reloadFreqs,
+	"lockout":       (*Receiver).reloadLockouts,
+	"hang":          (*Receiver).reloadScan,
+	"resume":        (*Receiver).reloadScan,
+	"direct":        (*Receiver).reloadSampling,
+	"offset-tuning": (*Receiver).reloadSampling,
+}
+
+// reload rereads the configuration file on SIGHUP, applying the settings
+// which have changed to the running receivers where it can and reporting
+// those which need a restart.
+func reload(opts *options) {
+	next, rs, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Reload failed, keeping the running configuration: %s\n", err)
+		return
+	}
+
+	var applied, restart []string
+	if next.http != opts.http {
+		restart = append(restart, "-http")
+	}
+	if next.tlsCert != opts.tlsCert || next.tlsKey != opts.tlsKey {
+		restart = append(restart, "-tls-cert and -tls-key")
+	}
+	// the credentials are reread even if -auth is unchanged, so they can
+	// be edited in place
+	if next.auth != "" || opts.auth != "" {
+		if next.auth == "" || opts.auth == "" {
+			restart = append(restart, "-auth")
+		} else if !sameCredentials(next.creds, opts.creds) {
+			server.setCredentials(next.creds)
+			opts.creds = next.creds
+			applied = append(applied, "-auth")
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, nr := range rs {
+		names[nr.name] = true
+		r := receiverNamed(nr.name)
+		if r == nil {
+			restart = append(restart, fmt.Sprintf("new receiver %s", nr.name))
+			continue
+		}
+
+		changed := make([]string, 0, len(nr.settings))
+		for name, val := range nr.settings {
+			if r.settings[name] != val {
+				changed = append(changed, name)
+			}
+		}
+		sort.Strings(changed)
+
+		for _, name := range changed {
+			fn, ok := liveSettings[name]
+			if !ok {
+				restart = append(restart, fmt.Sprintf("-%s on %s", name, r.name))
+				continue
+			}
+			if err = fn(r, nr); err != nil {
+				r.logf("Failed to apply -%s: %s\n", name, err)
+				continue
+			}
+			r.settings[name] = nr.settings[name]
+			applied = append(applied, fmt.Sprintf("-%s on %s", name, r.name))
+		}
+	}
+	for _, r := range receivers {
+		if !names[r.name] {
+			restart = append(restart, fmt.Sprintf("removed receiver %s", r.name))
+		}
+	}
+
+	switch {
+	case len(applied) == 0 && len(restart) == 0:
+		fmt.Fprintln(os.Stderr, "Reloaded configuration, nothing has changed.")
+	case len(applied) > 0:
+		fmt.Fprintf(os.Stderr, "Reloaded configuration, applied %s.\n", strings.Join(applied, ", "))
+	}
+	if len(restart) > 0 {
+		fmt.Fprintf(os.Stderr, "Restart to apply %s.\n", strings.Join(restart, ", "))
+	}
+}
+
+func receiverNamed(name string) *Receiver {
+	for _, r := range receivers {
+		if r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) reloadGain(next *Receiver) (err error) {
+	dongle := r.dongle
+	dongle.mu.Lock()
+	defer dongle.mu.Unlock()
+	if dongle.dev == nil {
+		return fmt.Errorf("Device is disconnected")
+	}
+
+	gain := next.dongle.gain
+	if gain == autoGain {
+		err = dongle.dev.SetTunerGainMode(false)
+	} else {
+		if gain, err = nearestGain(dongle.dev, gain*10); err != nil {
+			return
+		}
+		if err = dongle.dev.SetTunerGainMode(true); err == nil {
+			err = dongle.dev.SetTunerGain(gain)
+		}
+	}
+	if err == nil {
+		dongle.gain = gain
+	}
+	return
+}
+
+func (r *Receiver) reloadPPM(next *Receiver) (err error) {
+	dongle := r.dongle
+	dongle.mu.Lock()
+	defer dongle.mu.Unlock()
+	if dongle.dev == nil {
+		return fmt.Errorf("Device is disconnected")
+	}
+
+	if err = dongle.dev.SetFreqCorrection(next.dongle.ppmError); err == nil {
+		dongle.ppmError = next.dongle.ppmError
+	}
+	return
+}
+
+// reloadFreqs replaces the scan list, starting again from its first channel
+// unless stopped on a priority channel
+func (r *Receiver) reloadFreqs(next *Receiver) error {
+	if r.search.enabled || r.channelizer.enabled || r.survey.spec != "" {
+		return fmt.Errorf("Only the scanner's channels can be changed without a restart")
+	}
+
+	s := r.controller
+	return s.command(func() error {
+		s.mu.Lock()
+		s.freqs = next.controller.freqs
+		// lockouts of channels no longer scanned would otherwise linger,
+		// and be listed, until a restart
+		for freq := range s.lockouts {
+			if !s.hasChannel(freq) {
+				delete(s.lockouts, freq)
+				delete(s.configLockouts, freq)
+			}
+		}
+		s.mu.Unlock()
+
+		s.freqNow = 0
+		if s.priorityNow >= 0 {
+			return nil
+		}
+		s.activeSince = time.Time{}
+		s.quietSince = time.Time{}
+		return s.tune(s.freqs[0])
+	})
+}
+
+// reloadLockouts swaps the lockouts given at startup for the new ones,
+// keeping any made through the API
+func (r *Receiver) reloadLockouts(next *Receiver) error {
+	s := r.controller
+	for _, freq := range r.lockouts {
+		s.configUnlock(s.channelFreq(freq))
+	}
+	r.lockouts = next.lockouts
+	for _, freq := range r.lockouts {
+		if err := s.configLockout(s.channelFreq(freq)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) reloadScan(next *Receiver) error {
+	s := r.controller
+	return s.command(func() error {
+		s.hang = next.controller.hang
+		s.resume = next.controller.resume
+		return nil
+	})
+}
+
+func (r *Receiver) reloadSampling(next *Receiver) error {
+	s := r.controller
+	return s.command(func() error {
+		if err := r.setSampling(next.directSampling, next.offsetTuning); err != nil {
+			return err
+		}
+		r.directSampling, r.offsetTuning = next.directSampling, next.offsetTuning
+		// the capture frequency depends on the sampling mode
+		s.windowCenter = 0
+		return s.tune(s.current())
+	})
+}
@@ -0,0 +1,217 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{`squelch = 20`, `squelch = 20`},
+		{`squelch = 20 # quiet`, `squelch = 20 `},
+		{`# a comment`, ``},
+		{`device = "#1"`, `device = "#1"`},
+		{`device = '#1' # index`, `device = '#1' `},
+		{`name = "a \" # b" # c`, `name = "a \" # b" `},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.in); got != tt.want {
+			t.Errorf("stripComment(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    configValue
+		wantErr bool
+	}{
+		{`"roof"`, configValue{vals: []string{"roof"}}, false},
+		{`'C:\raw'`, configValue{vals: []string{`C:\raw`}}, false},
+		{`"tab\there"`, configValue{vals: []string{"tab\there"}}, false},
+		{`20`, configValue{vals: []string{"20"}}, false},
+		{`-2.5`, configValue{vals: []string{"-2.5"}}, false},
+		{`2_400_000`, configValue{vals: []string{"2400000"}}, false},
+		{`true`, configValue{vals: []string{"true"}}, false},
+		{`["145.5M", "145.6M:145.8M:12.5k"]`, configValue{vals: []string{"145.5M", "145.6M:145.8M:12.5k"}, array: true}, false},
+		{`["a,b", 'c',]`, configValue{vals: []string{"a,b", "c"}, array: true}, false},
+		{`[]`, configValue{array: true}, false},
+		{`roof`, configValue{}, true},
+		{`"roof`, configValue{}, true},
+		{`'roof`, configValue{}, true},
+		{`["a", ["b"]]`, configValue{}, true},
+		{`["a"`, configValue{}, true},
+		{`[bare]`, configValue{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseConfigValue(%s) error = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseConfigValue(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    *configFile
+		wantErr bool
+	}{
+		{
+			name: "receivers",
+			text: `http = ":8080" # the API
+
+[[receiver]]
+name = "roof"
+frequencies = [
+	"145.5M",   # calling
+	"145.6M:145.8M:12.5k",
+]
+squelch = 20
+
+[[receiver]]
+name = "loft"
+`,
+			want: &configFile{
+				global: configSection{"http": {vals: []string{":8080"}, line: 1}},
+				receivers: []configSection{
+					{
+						"name":        {vals: []string{"roof"}, line: 4},
+						"frequencies": {vals: []string{"145.5M", "145.6M:145.8M:12.5k"}, array: true, line: 5},
+						"squelch":     {vals: []string{"20"}, line: 9},
+					},
+					{"name": {vals: []string{"loft"}, line: 12}},
+				},
+			},
+		},
+		{name: "empty", text: "# nothing\n\n", want: &configFile{global: configSection{}}},
+		{name: "duplicate key", text: "squelch = 1\nsquelch = 2\n", wantErr: true},
+		{name: "unknown table", text: "[receiver]\n", wantErr: true},
+		{name: "missing value", text: "squelch\n", wantErr: true},
+		{name: "bad value", text: "squelch = loud\n", wantErr: true},
+		{name: "unterminated array", text: "frequencies = [\n\"145.5M\",\n", wantErr: true},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		filename := filepath.Join(dir, "sdrctl.toml")
+		if err := os.WriteFile(filename, []byte(tt.text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadConfig(filename)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: loadConfig error = %v, want error %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		tt.want.filename = filename
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loadConfig = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReloadFreqsDropsLockouts(t *testing.T) {
+	r := newReceiver()
+	r.demod.modeDemod = fmDemod
+	r.demod.rateIn = 24000
+	s := r.controller
+	s.freqs = frequencies{145500000, 145600000}
+	for _, freq := range s.freqs {
+		if err := s.lockout(freq, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go func() { (<-s.cmdChan)() }()
+	next := newReceiver()
+	next.controller.freqs = frequencies{145600000, 145700000}
+	if err := r.reloadFreqs(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.lockedOut(145500000, s.lastQuiet); ok {
+		t.Error("lockout of a removed channel was kept")
+	}
+	if _, ok := s.lockedOut(145600000, s.lastQuiet); !ok {
+		t.Error("lockout of a remaining channel was dropped")
+	}
+	if s.isChannel(145500000) || !s.isChannel(145700000) {
+		t.Error("scan list wasn't replaced")
+	}
+}
+
+func TestReloadLockoutsKeepsAPILockouts(t *testing.T) {
+	r := newReceiver()
+	s := r.controller
+	s.freqs = frequencies{145500000, 145600000, 145700000, 145800000}
+	r.lockouts = frequencies{145500000, 145600000}
+	for _, freq := range r.lockouts {
+		if err := s.configLockout(freq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// skipped, then locked out for good, through the API
+	if err := s.lockout(145600000, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.lockout(145700000, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	next := newReceiver()
+	next.lockouts = frequencies{145800000}
+	if err := r.reloadLockouts(next); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		freq   uint32
+		locked bool
+	}{
+		{145500000, false},
+		{145600000, true},
+		{145700000, true},
+		{145800000, true},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		if _, ok := s.lockedOut(tt.freq, now); ok != tt.locked {
+			t.Errorf("%d Hz locked out %t after reload, want %t", tt.freq, ok, tt.locked)
+		}
+	}
+
+	// lifted by the next reload, being the config's
+	if err := r.reloadLockouts(newReceiver()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.lockedOut(145800000, now); ok {
+		t.Error("lockout from the previous config was kept")
+	}
+}
@@ -0,0 +1,536 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+type deviceStatus struct {
+	Name           string `json:"name"`
+	Index          int    `json:"index"`
+	Serial         string `json:"serial"`
+	Freq           uint32 `json:"freq"`
+	Rate           uint32 `json:"rate"`
+	Gain           int    `json:"gain"`
+	PPMError       int    `json:"ppm_error"`
+	DirectSampling int    `json:"direct_sampling"`
+	OffsetTuning   bool   `json:"offset_tuning"`
+}
+
+const (
+	healthStreaming    = "streaming"
+	healthReconnecting = "reconnecting"
+)
+
+type healthStatus struct {
+	Name       string    `json:"name"`
+	Serial     string    `json:"serial"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// listDevices prints every dongle attached, for choosing one with -d
+func listDevices() {
+	count := rtl.GetDeviceCount()
+	if count == 0 {
+		fmt.Fprintln(os.Stderr, "No supported devices found.")
+		return
+	}
+
+	fmt.Printf("%-6s %-20s %-24s %s\n", "INDEX", "MANUFACTURER", "PRODUCT", "SERIAL")
+	for i := 0; i < count; i++ {
+		manufact, product, serial, err := rtl.GetDeviceUsbStrings(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading device %d: %s\n", i, err)
+			continue
+		}
+		fmt.Printf("%-6d %-20s %-24s %s\n", i, manufact, product, serial)
+	}
+}
+
+// findDevice resolves -d to a device index. USB enumeration order changes,
+// so serials are preferred: an exact serial matches first, then an index,
+// then a unique part of a serial. A part of a serial which is all digits
+// would be taken as an index, so it's given as serial:0002, and #n is an
+// index too.
+func findDevice(spec string) (index int, err error) {
+	serials, err := deviceSerials()
+	if err != nil {
+		return
+	}
+	return matchDevice(spec, serials)
+}
+
+// findSerial finds the one device with exactly the serial given
+func findSerial(serial string) (index int, err error) {
+	serials, err := deviceSerials()
+	if err != nil {
+		return
+	}
+	return matchSerial(serial, serials)
+}
+
+func deviceSerials() (serials []string, err error) {
+	count := rtl.GetDeviceCount()
+	if count == 0 {
+		return nil, fmt.Errorf("No supported devices found")
+	}
+
+	serials = make([]string, count)
+	for i := range serials {
+		_, _, serials[i], err = rtl.GetDeviceUsbStrings(i)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading device %d: %s", i, err)
+		}
+	}
+	return
+}
+
+// matchDevice finds spec among the serials of the devices, as findDevice
+func matchDevice(spec string, serials []string) (index int, err error) {
+	if spec == "" {
+		return 0, nil
+	}
+
+	for i, serial := range serials {
+		if serial == spec {
+			return i, nil
+		}
+	}
+
+	if strings.HasPrefix(spec, "#") {
+		if index, err = strconv.Atoi(spec[1:]); err != nil {
+			return 0, fmt.Errorf("Invalid device index '%s'", spec)
+		}
+		return deviceIndex(index, len(serials))
+	}
+	if index, err = strconv.Atoi(spec); err == nil {
+		if index, err = deviceIndex(index, len(serials)); err != nil {
+			err = fmt.Errorf("%s; give part of a serial as serial:%s", err, spec)
+		}
+		return
+	}
+
+	part := strings.TrimPrefix(spec, "serial:")
+	if part == "" {
+		return 0, fmt.Errorf("Invalid device serial '%s'", spec)
+	}
+	index = -1
+	for i, serial := range serials {
+		if !strings.Contains(serial, part) {
+			continue
+		}
+		if index >= 0 {
+			return 0, fmt.Errorf("Serial '%s' matches more than one device, give all of it or the index", part)
+		}
+		index = i
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("No device with serial matching '%s'", part)
+	}
+	return index, nil
+}
+
+// matchSerial finds serial among the serials of the devices, which must
+// match it exactly and only once
+func matchSerial(serial string, serials []string) (index int, err error) {
+	index = -1
+	for i, s := range serials {
+		if s != serial {
+			continue
+		}
+		if index >= 0 {
+			return 0, fmt.Errorf("Serial '%s' belongs to more than one device", serial)
+		}
+		index = i
+	}
+	if index < 0 {
+		return 0, fmt.Errorf("No device with serial '%s'", serial)
+	}
+	return index, nil
+}
+
+func deviceIndex(index, count int) (int, error) {
+	if index < 0 || index >= count {
+		return 0, fmt.Errorf("Device index %d out of range, %d devices found", index, count)
+	}
+	return index, nil
+}
+
+// checkDirectSampling refuses an unknown direct sampling mode, or one that
+// can't receive all of the channels given
+func checkDirectSampling(direct int, channels ...frequencies) error {
+	if direct < 0 || direct > 2 {
+		return fmt.Errorf("Direct sampling mode must be 0 (off), 1 (I branch) or 2 (Q branch)")
+	}
+	if direct == 0 {
+		return nil
+	}
+	for _, freqs := range channels {
+		for _, freq := range freqs {
+			if freq > rtl.CrystalFreq {
+				return fmt.Errorf("Frequency %d Hz is above the %d Hz limit of direct sampling.", freq, rtl.CrystalFreq)
+			}
+		}
+	}
+	return nil
+}
+
+// setSampling applies the direct sampling and offset tuning modes. Direct
+// sampling bypasses the tuner, feeding the I (1) or Q (2) ADC branch straight
+// from the antenna for HF reception. Offset tuning moves zero-IF tuners away
+// from their own DC spike, so the quarter rate offset of preRotate is no
+// longer needed.
+func (r *Receiver) setSampling(direct int, offset bool) (err error) {
+	dongle := r.dongle
+	if err = checkDirectSampling(direct); err != nil {
+		return
+	}
+
+	dongle.mu.Lock()
+	defer dongle.mu.Unlock()
+	if dongle.dev == nil {
+		return fmt.Errorf("Device is disconnected")
+	}
+
+	err = dongle.dev.SetDirectSampling(rtl.SamplingMode(direct))
+	if err != nil {
+		return fmt.Errorf("Error setting direct sampling to %d: %s", direct, err)
+	}
+	dongle.directSampling = direct
+
+	// offset tuning is unsupported by some tuners, so leave it be unless it's
+	// changing
+	if offset != dongle.offsetTuning {
+		err = dongle.dev.SetOffsetTuning(offset)
+		if err != nil {
+			return fmt.Errorf("Error setting offset tuning: %s", err)
+		}
+	}
+	dongle.offsetTuning = offset
+	dongle.preRotate = !offset
+
+	r.logf("Direct sampling %s, offset tuning %t.\n", rtl.SamplingModes[rtl.SamplingMode(direct)], offset)
+	return
+}
+
+// dongleTuning is a consistent view of the dongle's tuning, for goroutines
+// other than the one retuning it
+type dongleTuning struct {
+	freq      uint32
+	rate      uint32
+	preRotate bool
+}
+
+func (dongle *dongleState) tuning() dongleTuning {
+	dongle.mu.RLock()
+	defer dongle.mu.RUnlock()
+	return dongleTuning{freq: dongle.freq, rate: dongle.rate, preRotate: dongle.preRotate}
+}
+
+func (dongle *dongleState) setTuning(freq, rate uint32) {
+	dongle.mu.Lock()
+	dongle.freq, dongle.rate = freq, rate
+	dongle.mu.Unlock()
+}
+
+// center is the frequency at the centre of the buffers given to
+// demodRoutine, once any quarter rate offset has been rotated away
+func (t dongleTuning) center() uint32 {
+	if t.preRotate {
+		return t.freq - t.rate/4
+	}
+	return t.freq
+}
+
+// window is the range of frequencies a channel bandwidth wide may be centred
+// on, clear of the roll-off at the edges of the capture; it's around the
+// frequency the dongle is tuned to, not the centre, as the capture is.
+func (t dongleTuning) window(bandwidth int) (low, high uint32) {
+	half := uint32(int(float64(t.rate)*usableBandwidth)-bandwidth) / 2
+	return t.freq - half, t.freq + half
+}
+
+// reaches reports whether a channel bandwidth wide at freq may be
+// demodulated from the capture: within window, and clear of the DC spike at
+// the tuned frequency, which preRotate moves away from the centre.
+func (t dongleTuning) reaches(freq uint32, bandwidth int) bool {
+	low, high := t.window(bandwidth)
+	if freq < low || freq > high {
+		return false
+	}
+	if offset := int(freq) - int(t.freq); t.preRotate && offset > -bandwidth && offset < bandwidth {
+		return false
+	}
+	return true
+}
+
+// setCenterFreq tunes the dongle to freq. Whilst it's being reopened the
+// frequency is only recorded, and applied once it's back.
+func (dongle *dongleState) setCenterFreq() error {
+	dongle.mu.RLock()
+	defer dongle.mu.RUnlock()
+	if dongle.dev == nil {
+		return nil
+	}
+	return dongle.dev.SetCenterFreq(int(dongle.freq))
+}
+
+// apply restores the dongle's settings to a freshly reopened device
+func (dongle *dongleState) apply(dev *rtl.Context) (err error) {
+	if dongle.directSampling != 0 {
+		if err = dev.SetDirectSampling(rtl.SamplingMode(dongle.directSampling)); err != nil {
+			return
+		}
+	}
+	if dongle.offsetTuning {
+		if err = dev.SetOffsetTuning(true); err != nil {
+			return
+		}
+	}
+	if dongle.gain == autoGain {
+		err = dev.SetTunerGainMode(false)
+	} else if err = dev.SetTunerGainMode(true); err == nil {
+		err = dev.SetTunerGain(dongle.gain)
+	}
+	if err != nil {
+		return
+	}
+	if dongle.ppmError != 0 {
+		if err = dev.SetFreqCorrection(dongle.ppmError); err != nil {
+			return
+		}
+	}
+	if err = dev.SetSampleRate(int(dongle.rate)); err != nil {
+		return
+	}
+	if err = dev.SetCenterFreq(int(dongle.freq)); err != nil {
+		return
+	}
+	return dev.ResetBuffer()
+}
+
+// setHealth records the state of the device, with mu held
+func (dongle *dongleState) setHealth(state string, err error) {
+	if state != dongle.health {
+		dongle.health = state
+		dongle.healthSince = time.Now()
+	}
+	if err != nil {
+		dongle.lastError = err.Error()
+	}
+}
+
+// reconnect closes a dongle which has failed, then reopens it by serial, as
+// its index may change when it reappears on the bus. Attempts back off
+// exponentially, continuing until the dongle is back (true) or the receiver
+// is stopped (false).
+func (r *Receiver) reconnect(cause error) bool {
+	dongle := r.dongle
+
+	dongle.mu.Lock()
+	dongle.dev.Close()
+	dongle.dev = nil
+	dongle.setHealth(healthReconnecting, cause)
+	dongle.mu.Unlock()
+
+	// by the whole serial, lest another receiver's dongle be taken whilst
+	// it's away
+	spec := "serial " + dongle.serial
+	if dongle.serial == "" {
+		spec = r.devSpec
+	}
+
+	backoff := reconnectMin
+	for {
+		r.logf("Reopening device %s in %s\n", spec, backoff)
+		select {
+		case <-r.ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		err := r.reopen()
+		if err == nil {
+			r.logf("Reconnected to device %d (serial %s)\n", dongle.devIndex, dongle.serial)
+			return true
+		}
+		r.logf("Failed to reopen device, '%s'\n", err)
+
+		dongle.mu.Lock()
+		dongle.setHealth(healthReconnecting, err)
+		dongle.mu.Unlock()
+
+		if backoff *= 2; backoff > reconnectMax {
+			backoff = reconnectMax
+		}
+	}
+}
+
+func (r *Receiver) reopen() (err error) {
+	dongle := r.dongle
+
+	var index int
+	if dongle.serial != "" {
+		index, err = findSerial(dongle.serial)
+	} else {
+		index, err = findDevice(r.devSpec)
+	}
+	if err != nil {
+		return
+	}
+	dev, err := rtl.Open(index)
+	if err != nil {
+		return
+	}
+
+	dongle.mu.Lock()
+	defer dongle.mu.Unlock()
+
+	if err = dongle.apply(dev); err != nil {
+		dev.Close()
+		return
+	}
+	dongle.dev = dev
+	dongle.devIndex = index
+	atomic.StoreInt32(&dongle.mute, bufferDump)
+	dongle.reconnects++
+	dongle.setHealth(healthStreaming, nil)
+	return
+}
+
+// handleHealth reports the state of each receiver's dongle, failing whilst
+// any is being reconnected
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	status := make([]healthStatus, 0, len(receivers))
+	healthy := true
+	for _, rx := range receivers {
+		if rx.calibrateOnly {
+			continue
+		}
+		d := rx.dongle
+		d.mu.RLock()
+		status = append(status, healthStatus{
+			Name:       rx.name,
+			Serial:     d.serial,
+			State:      d.health,
+			Since:      d.healthSince,
+			Reconnects: d.reconnects,
+			LastError:  d.lastError,
+		})
+		if d.health != healthStreaming {
+			healthy = false
+		}
+		d.mu.RUnlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, status)
+}
+
+func handleDevice(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	dongle, controller := rx.dongle, rx.controller
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		dongle.mu.RLock()
+		direct, offset := dongle.directSampling, dongle.offsetTuning
+		dongle.mu.RUnlock()
+		var err error
+		if val := r.URL.Query().Get("direct"); val != "" {
+			if direct, err = strconv.Atoi(val); err != nil {
+				http.Error(w, "Invalid direct sampling mode", http.StatusBadRequest)
+				return
+			}
+		}
+		if val := r.URL.Query().Get("offset"); val != "" {
+			if offset, err = strconv.ParseBool(val); err != nil {
+				http.Error(w, "Invalid offset tuning mode", http.StatusBadRequest)
+				return
+			}
+		}
+		// the scan list is replaced on reload
+		controller.mu.Lock()
+		freqs, priority := controller.freqs, controller.priority
+		controller.mu.Unlock()
+		if err = checkDirectSampling(direct, freqs, priority); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = controller.command(func() error {
+			if err := rx.setSampling(direct, offset); err != nil {
+				return err
+			}
+			// the capture frequency depends on the sampling mode
+			controller.windowCenter = 0
+			return controller.tune(controller.current())
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, rx.status())
+}
+
+func (r *Receiver) status() deviceStatus {
+	r.dongle.mu.RLock()
+	defer r.dongle.mu.RUnlock()
+	return deviceStatus{
+		Name:           r.name,
+		Index:          r.dongle.devIndex,
+		Serial:         r.dongle.serial,
+		Freq:           r.dongle.freq,
+		Rate:           r.dongle.rate,
+		Gain:           r.dongle.gain,
+		PPMError:       r.dongle.ppmError,
+		DirectSampling: r.dongle.directSampling,
+		OffsetTuning:   r.dongle.offsetTuning,
+	}
+}
+
+// handleReceivers lists the receivers, by which the other requests may be
+// directed with ?receiver=name
+func handleReceivers(w http.ResponseWriter, r *http.Request) {
+	status := make([]deviceStatus, 0, len(receivers))
+	for _, rx := range receivers {
+		status = append(status, rx.status())
+	}
+	writeJSON(w, status)
+}
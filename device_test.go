@@ -0,0 +1,220 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMatchDevice(t *testing.T) {
+	serials := []string{"00000001", "00000002", "ROOF-VHF", "LOFT-UHF", ""}
+	tests := []struct {
+		spec    string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"00000002", 1, false},
+		{"ROOF", 2, false},
+		{"-UHF", 3, false},
+		{"serial:ROOF", 2, false},
+		{"serial:0002", 1, false},
+		{"serial:00000001", 0, false},
+		// plain numbers are indices, though in the default serials
+		{"0", 0, false},
+		{"1", 1, false},
+		{"2", 2, false},
+		{"4", 4, false},
+		{"0002", 2, false},
+		{"#2", 2, false},
+		{"#0", 0, false},
+		{"9", 0, true},
+		{"00009", 0, true},
+		{"serial:0000000", 0, true},
+		{"serial:", 0, true},
+		{"HF", 0, true},
+		{"ATTIC", 0, true},
+		{"#5", 0, true},
+		{"#-1", 0, true},
+		{"#ROOF", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := matchDevice(tt.spec, serials)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("matchDevice(%q) error = %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("matchDevice(%q) = %d, want %d", tt.spec, got, tt.want)
+		}
+	}
+
+	// the common default serials, which are no substitute for an index
+	serials = []string{"00000001", "00000001", "00000002"}
+	for i := range serials {
+		if got, err := matchDevice(strconv.Itoa(i), serials); err != nil || got != i {
+			t.Errorf("matchDevice(%q) among %q = %d, %v; want %d", strconv.Itoa(i), serials, got, err, i)
+		}
+	}
+	if _, err := matchDevice("serial:00000001", serials); err == nil {
+		t.Errorf("matchDevice(\"serial:00000001\") among duplicates succeeded")
+	}
+}
+
+// TestMatchSerial checks a dongle is reopened by its whole serial, which
+// may be part of another's
+func TestMatchSerial(t *testing.T) {
+	serials := []string{"00000001", "00000011", "SDR10", "SDR1", "SDR1"}
+	tests := []struct {
+		serial  string
+		want    int
+		wantErr bool
+	}{
+		{"00000001", 0, false},
+		{"00000011", 1, false},
+		{"SDR10", 2, false},
+		{"0000001", 0, true},
+		{"SDR", 0, true},
+		// duplicates can't be told apart
+		{"SDR1", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := matchSerial(tt.serial, serials)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("matchSerial(%q) error = %v, want error %t", tt.serial, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("matchSerial(%q) = %d, want %d", tt.serial, got, tt.want)
+		}
+	}
+
+	// where -d takes part of a serial, and would find both
+	if _, err := matchDevice("serial:SDR1", serials[2:4]); err == nil {
+		t.Errorf("matchDevice(\"serial:SDR1\") among %q succeeded", serials[2:4])
+	}
+}
+
+// TestTuningReaches checks channels are reached around the frequency the
+// dongle is tuned to, which preRotate puts a quarter of the rate above the
+// centre of the rotated capture
+func TestTuningReaches(t *testing.T) {
+	rotated := dongleTuning{freq: 100000000, rate: 2400000, preRotate: true}
+	offset := dongleTuning{freq: 100000000, rate: 2400000}
+	tests := []struct {
+		tuning dongleTuning
+		freq   uint32
+		want   bool
+	}{
+		// the capture runs from 98.8 to 101.2MHz, usable from 99.052 to
+		// 100.948MHz, whatever its centre once rotated
+		{rotated, 99200000, true},
+		{rotated, 99052000, true},
+		{rotated, 99051999, false},
+		{rotated, 98800000, false},
+		{rotated, 98500000, false},
+		{rotated, 100948000, true},
+		{rotated, 100948001, false},
+		// DC spike
+		{rotated, 100000000, false},
+		{rotated, 99976001, false},
+		{rotated, 100023999, false},
+		{rotated, 99976000, true},
+		{rotated, 100024000, true},
+		// offset tuning leaves no spike
+		{offset, 100000000, true},
+		{offset, 99052000, true},
+		{offset, 98800000, false},
+	}
+	for _, tt := range tests {
+		if got := tt.tuning.reaches(tt.freq, 24000); got != tt.want {
+			t.Errorf("%+v reaches(%d) = %t, want %t", tt.tuning, tt.freq, got, tt.want)
+		}
+	}
+}
+
+// TestTuningWhilstRead retunes the dongle as the controller does, whilst
+// the callback, sessions, the device status and the metrics read its
+// tuning; it's for running with -race.
+func TestTuningWhilstRead(t *testing.T) {
+	r := newReceiver()
+	r.demod.modeDemod = fmDemod
+	r.demod.rateIn = 24000
+	r.dongle.lpChan = make(chan []int16, 4)
+	r.dongle.pool = newBufferPool(6)
+	r.sessions.max = 1
+	r.sessions.demod = *r.demod
+
+	saved := receivers
+	receivers = []*Receiver{r}
+	defer func() { receivers = saved }()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			if err := r.controller.tune(uint32(100e6 + i*1e6)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 512)
+	for i := 0; i < 100; i++ {
+		r.rtlsdrCallback(buf)
+		r.dongle.pool.put(<-r.dongle.lpChan)
+
+		r.status()
+		r.tuneSession(sessionSettings{}, sessionTune{Freq: "100M"})
+		r.sessionDemod(sessionSettings{mode: "fm", squelch: 10}, r.dongle.tuning().rate)
+		handleMetrics(httptest.NewRecorder(), httptest.NewRequest("GET", "/metrics", nil))
+	}
+	wg.Wait()
+}
+
+func TestDeviceDirectSampling(t *testing.T) {
+	tests := []struct {
+		query    string
+		freqs    frequencies
+		priority frequencies
+	}{
+		{"direct=1", frequencies{7074000, 145500000}, nil},
+		{"direct=2&offset=false", frequencies{7074000}, frequencies{145800000}},
+		{"direct=3", frequencies{7074000}, nil},
+	}
+	for _, tt := range tests {
+		r := newReceiver()
+		r.controller.freqs = tt.freqs
+		r.controller.priority = tt.priority
+
+		saved := receivers
+		receivers = []*Receiver{r}
+
+		// refused before reaching controllerRoutine, which isn't running
+		w := httptest.NewRecorder()
+		handleDevice(w, httptest.NewRequest(http.MethodPost, "/device?"+tt.query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s with channels %v, %v: status %d, want %d", tt.query, tt.freqs, tt.priority, w.Code, http.StatusBadRequest)
+		}
+		receivers = saved
+	}
+}
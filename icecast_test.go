@@ -0,0 +1,144 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestIcecastStream streams to a stub server, checking the source
+// handshake, and that the body is Ogg Opus, chaining a stream for each title
+func TestIcecastStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type request struct {
+		req  *http.Request
+		body []byte
+		err  error
+	}
+	got := make(chan request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			got <- request{err: err}
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			got <- request{err: err}
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+		// the body runs on without a length, until the source hangs up
+		body, err := ioutil.ReadAll(br)
+		got <- request{req, body, err}
+	}()
+
+	r := newReceiver()
+	r.name = "roof"
+	r.output.rate = 24000
+	r.controller.tuned = 145500000
+	r.icecast.urlStr = "http://source:hackme@" + ln.Addr().String() + "/scanner"
+	r.icecast.bitrateStr = "32k"
+	if err = r.icecast.configure(r); err != nil {
+		t.Fatal(err)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+
+	l := newListener(1)
+	done := make(chan error, 1)
+	go func() { done <- r.icecastStream(l) }()
+
+	tone := testSignal(r.output.rate, r.output.rate/10)
+	for i := 0; i < 20; i++ {
+		if i == 10 {
+			r.controller.mu.Lock()
+			r.controller.tuned = 145612500
+			r.controller.mu.Unlock()
+		}
+		buf := l.pool.get(len(tone))[:0]
+		l.audio <- audioChunk{buf: append(buf, tone...)}
+	}
+	l.close()
+	if err = <-done; err != nil {
+		t.Fatalf("icecastStream returned '%s'", err)
+	}
+
+	res := <-got
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("source:hackme"))
+	headers := []struct {
+		name, want string
+	}{
+		{"Authorization", auth},
+		{"Content-Type", "audio/ogg"},
+		{"Ice-Name", "sdrctl roof"},
+		{"Ice-Public", "0"},
+		{"Ice-Audio-Info", "samplerate=24000;channels=1;bitrate=32"},
+		{"Expect", "100-continue"},
+	}
+	if res.req.Method != http.MethodPut || res.req.RequestURI != "/scanner" {
+		t.Errorf("request %s %s, want PUT /scanner", res.req.Method, res.req.RequestURI)
+	}
+	for _, h := range headers {
+		if v := res.req.Header.Get(h.name); v != h.want {
+			t.Errorf("%s: %q, want %q", h.name, v, h.want)
+		}
+	}
+
+	packets, _, flags := oggPackets(t, res.body)
+	var titles []string
+	for _, p := range packets {
+		if strings.HasPrefix(string(p), "OpusTags") {
+			i := strings.Index(string(p), "TITLE=")
+			if i < 0 {
+				t.Fatal("OpusTags without a TITLE")
+			}
+			titles = append(titles, string(p[i+len("TITLE="):]))
+		}
+	}
+	want := []string{"145.5000 MHz", "145.6125 MHz"}
+	if len(titles) != len(want) || titles[0] != want[0] || titles[1] != want[1] {
+		t.Errorf("stream titles %q, want %q", titles, want)
+	}
+	var bos, eos int
+	for _, f := range flags {
+		if f&oggBOS != 0 {
+			bos++
+		}
+		if f&oggEOS != 0 {
+			eos++
+		}
+	}
+	if bos != 2 || eos != 2 || flags[len(flags)-1]&oggEOS == 0 {
+		t.Errorf("%d streams begun and %d ended, want 2 chained", bos, eos)
+	}
+}
@@ -0,0 +1,140 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// wideband channels are tuned 16kHz above the requested frequency
+const wbOffset = 16000
+
+// channelFreq converts a requested frequency to the one held in freqs
+func (s *controllerState) channelFreq(freq uint32) uint32 {
+	if s.wbMode {
+		return freq + wbOffset
+	}
+	return freq
+}
+
+// userFreq converts a channel held in freqs back to the requested frequency
+func (s *controllerState) userFreq(freq uint32) uint32 {
+	if s.wbMode {
+		return freq - wbOffset
+	}
+	return freq
+}
+
+// isChannel reports whether freq is scanned, as a priority channel or
+// otherwise; the scan list may be swapped on reload, so it takes mu
+func (s *controllerState) isChannel(freq uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hasChannel(freq)
+}
+
+// hasChannel is isChannel, for callers holding mu
+func (s *controllerState) hasChannel(freq uint32) bool {
+	for _, f := range s.freqs {
+		if f == freq {
+			return true
+		}
+	}
+	for _, f := range s.priority {
+		if f == freq {
+			return true
+		}
+	}
+	return false
+}
+
+// lockout excludes a channel from the scan; permanently when d is zero,
+// otherwise it is skipped until d has elapsed.
+func (s *controllerState) lockout(freq uint32, d time.Duration) error {
+	var until time.Time
+	if d > 0 {
+		until = time.Now().Add(d)
+	}
+
+	s.mu.Lock()
+	if !s.hasChannel(freq) {
+		s.mu.Unlock()
+		return fmt.Errorf("%d Hz is not a configured channel", s.userFreq(freq))
+	}
+	s.lockouts[freq] = until
+	// it's the API's now, should it have come from the config
+	delete(s.configLockouts, freq)
+	s.mu.Unlock()
+
+	// move off the channel if we're stopped on it
+	select {
+	case s.lockChan <- true:
+	default:
+	}
+	return nil
+}
+
+func (s *controllerState) unlock(freq uint32) {
+	s.mu.Lock()
+	delete(s.lockouts, freq)
+	delete(s.configLockouts, freq)
+	s.mu.Unlock()
+}
+
+// configLockout permanently excludes a channel as the config asks, such
+// that a reload of the config may lift it again
+func (s *controllerState) configLockout(freq uint32) error {
+	if err := s.lockout(freq, 0); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.configLockouts[freq] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// configUnlock lifts a lockout the config gave, leaving it be should it have
+// been replaced through the API since
+func (s *controllerState) configUnlock(freq uint32) {
+	s.mu.Lock()
+	if s.configLockouts[freq] {
+		delete(s.lockouts, freq)
+		delete(s.configLockouts, freq)
+	}
+	s.mu.Unlock()
+}
+
+// lockedOut reports whether freq is excluded from the scan, and until when;
+// a zero time denotes a permanent lockout. Expired skips are removed.
+func (s *controllerState) lockedOut(freq uint32, now time.Time) (until time.Time, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok = s.lockouts[freq]
+	if ok && !until.IsZero() && now.After(until) {
+		delete(s.lockouts, freq)
+		return time.Time{}, false
+	}
+	return
+}
+
+// tunedFreq returns the channel the dongle was last tuned to, and may be
+// called from outside controllerRoutine.
+func (s *controllerState) tunedFreq() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tuned
+}
@@ -21,16 +21,20 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
+	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	rtl "github.com/jpoirier/gortlsdr"
@@ -44,27 +48,71 @@ const (
 	autoGain          = -100
 	bufferDump        = 4096
 	minimumRate       = 1000000
+	// largest magnitude of an IQ sample, once mixed
+	mixerPeak = 182
+	// bytes per read from the dongle, as ReadAsync used by default
+	readLen = 16 * 32 * 512
 
 	frequenciesLimit = 1000
+
+	// proportion of the measured carrier offset corrected per buffer, and
+	// the change in correction worth reporting
+	afcGain       = 0.1
+	afcReportStep = 250
+
+	// longest a control API request waits for controllerRoutine
+	commandTimeout = 2 * time.Second
+
+	// least time between reports of overruns
+	overrunReportInterval = time.Second
+
+	// longest to wait for the outputs to be closed once stopping has timed
+	// out
+	abortTimeout = time.Second
+
+	// bounds on the backoff between attempts to reopen a lost dongle
+	reconnectMin = time.Second
+	reconnectMax = time.Minute
 )
 
 // used to parse multiple -f params
 type frequencies []uint32
-type exitChan chan struct{}
 
 type dongleState struct {
 	dev            *rtl.Context
 	devIndex       int
+	serial         string
 	freq           uint32
 	rate           uint32
 	gain           int
 	ppmError       int
 	offsetTuning   bool
 	directSampling int
-	mute           int
+	mute           int32
 	demodTarget    *demodState
 	lpChan         chan []int16
+	pool           *bufferPool
 	preRotate      bool
+
+	// lpChan is bounded, so when demodRoutine falls behind buffers are
+	// dropped, rather than blocking the reads and losing samples unnoticed
+	// within the USB stack
+	dropOldest      bool
+	overruns        int
+	overrunSamples  int
+	overrunSince    time.Time
+	overrunReported time.Time
+
+	// mu guards dev, which is replaced when the dongle is reopened after
+	// dropping off the bus, and the health of the device. The tuning, from
+	// freq to preRotate, is only changed by the goroutine retuning the
+	// dongle, under mu, so that others may read it by holding mu or through
+	// tuning.
+	mu          sync.RWMutex
+	health      string
+	healthSince time.Time
+	reconnects  int
+	lastError   string
 }
 
 type demodState struct {
@@ -72,8 +120,8 @@ type demodState struct {
 	rateIn    int
 	rateOut   int
 	rateOut2  int
-	nowR      int16
-	nowJ      int16
+	nowR      int32
+	nowJ      int32
 	preR      int16
 	preJ      int16
 	prevIndex int
@@ -87,28 +135,104 @@ type demodState struct {
 	customAtan     int
 	deemph         bool
 	deemphA        int
+	deemphAvg      int
 	nowLpr         int
 	prevLprIndex   int
 	modeDemod      func(fm *demodState)
 	agcEnable      bool
 	agc            agcState
+	level          int
+	afcEnable      bool
+	afcShift       float64
+	afcReported    float64
+	mix            *mixer
+	// reports from the demodulator, through its receiver
+	logf func(format string, a ...interface{})
+	// shift applied by the input mixer to reach channels within the capture
+	// bandwidth without retuning, set by controllerRoutine
+	tuneShift int64
 }
 
 type outputState struct {
+	// first, to be aligned for atomic access
+	writeErrors uint64
+
 	file     *os.File
 	filename string
 	rate     int
 	pad      bool
 
-	resultChan chan []int16
+	resultChan chan audioChunk
+	pool       *bufferPool
+	// closed to have outputRoutine close the output and return, should
+	// resultChan not be closed in time on shutdown; it closes aborted once
+	// it has
+	abort   chan struct{}
+	aborted chan struct{}
+	// reused for encoding buffers, and padding gaps
+	bytes   []byte
+	silence []int16
+
+	codec   string
+	bitrate int
+	enc     encoder
+	logf    func(format string, a ...interface{})
+	dataLen uint32
+	samples uint32
+
+	// sinks the audio is fanned out to, besides the file
+	mu       sync.Mutex
+	sinks    map[sink]bool
+	finished bool
 }
 
 type controllerState struct {
 	freqs   frequencies
 	freqNow int
 	wbMode  bool
-
-	hopChan chan bool
+	bufTime time.Duration
+
+	// channels within the capture bandwidth are reached by shifting
+	// digitally from windowCenter, rather than retuning the dongle
+	digitalTune  bool
+	windowCenter uint32
+
+	// priority channels are revisited every priorityInterval, even whilst
+	// stopped on an active channel
+	priority         frequencies
+	priorityInterval time.Duration
+	priorityNow      int
+	// set by probe for demodRoutine to report the squelch of the next buffer
+	// afresh, as it otherwise only reports the squelch opening
+	rearm int32
+
+	// dwell bounds the time spent on an active channel, hang delays resuming
+	// the scan after its squelch closes
+	dwell       time.Duration
+	hang        time.Duration
+	resume      bool
+	activeSince time.Time
+	quietSince  time.Time
+	lastQuiet   time.Time
+
+	// lockouts are shared with the HTTP server, keyed by channel and holding
+	// the expiry of temporary skips. freqs is only replaced under mu, on
+	// reload, so others may read it holding mu.
+	mu       sync.Mutex
+	lockouts map[uint32]time.Time
+	tuned    uint32
+	// lockouts given by -lockout or the config, rather than through the
+	// API, which are those a reload may lift
+	configLockouts map[uint32]bool
+
+	dongle  *dongleState
+	demod   *demodState
+	metrics *metricsState
+
+	hopChan    chan bool
+	activeChan chan bool
+	lockChan   chan bool
+	cmdChan    chan func()
 }
 
 type agcState struct {
@@ -121,41 +245,11 @@ type agcState struct {
 	err        int
 }
 
-var dongle *dongleState
-var demod *demodState
-var output *outputState
-var controller *controllerState
+var server *serverState
+var receivers []*Receiver
 
 func init() {
-	dongle = &dongleState{}
-	output = &outputState{}
-	demod = &demodState{}
-	controller = &controllerState{}
-
-	dongle.rate = defaultSampleRate
-	// tenths of a dB
-	dongle.gain = autoGain
-	dongle.demodTarget = demod
-	dongle.lpChan = make(chan []int16, 1)
-	dongle.preRotate = true
-
-	demod.rateIn = defaultSampleRate
-	demod.rateOut = defaultSampleRate
-	demod.conseqSquelch = 10
-	demod.squelchHits = 11
-	// once this works, default = 4
-	demod.postDownsample = 1
-	demod.agc.gainDen = 1 << 15
-	demod.agc.gainNum = demod.agc.gainDen
-	demod.agc.peakTarget = 1 << 14
-	demod.agc.gainMax = 256 * demod.agc.gainDen
-	demod.agc.decayStep = 1
-	demod.agc.attackStep = -2
-
-	output.rate = defaultSampleRate
-	output.resultChan = make(chan []int16, 1)
-
-	controller.hopChan = make(chan bool)
+	server = &serverState{}
 }
 
 func setFreqs(val string) (freqs frequencies, err error) {
@@ -208,7 +302,8 @@ func setFreqs(val string) (freqs frequencies, err error) {
 	return
 }
 
-// Convert frequency string to Hz
+// Convert frequency string to Hz, rounding to the nearest as decimal
+// fractions such as 446.00625M aren't exact in floating point
 // 90.2M = 90200000
 // 25K = 25000
 func freqHz(freqStr string) (freq uint32, err error) {
@@ -219,11 +314,11 @@ func freqHz(freqStr string) (freq uint32, err error) {
 	case strings.HasSuffix(upper, "K"):
 		upper = strings.TrimSuffix(upper, "K")
 		f64, err = strconv.ParseFloat(upper, 64)
-		freq = uint32(f64 * 1e3)
+		freq = uint32(math.Round(f64 * 1e3))
 	case strings.HasSuffix(upper, "M"):
 		upper = strings.TrimSuffix(upper, "M")
 		f64, err = strconv.ParseFloat(upper, 64)
-		freq = uint32(f64 * 1e6)
+		freq = uint32(math.Round(f64 * 1e6))
 	default:
 		if last := len(upper) - 1; last >= 0 {
 			upper = upper[:last]
@@ -234,79 +329,244 @@ func freqHz(freqStr string) (freq uint32, err error) {
 	return
 }
 
-func rtlsdrCallback(buf []byte) {
+func (r *Receiver) rtlsdrCallback(buf []byte) {
 	var i int
 
-	if dongle.mute > 0 && dongle.mute < len(buf) {
-		for i = 0; i < dongle.mute; i++ {
+	dongle := r.dongle
+	if mute := int(atomic.LoadInt32(&dongle.mute)); mute > 0 && mute < len(buf) {
+		for i = 0; i < mute; i++ {
 			buf[i] = 127
 		}
-		dongle.mute = 0
+		atomic.StoreInt32(&dongle.mute, 0)
 	}
-	if dongle.preRotate {
+	tuning := dongle.tuning()
+	if r.spectrum.enabled {
+		r.spectrum.tap(buf, tuning.freq, tuning.rate)
+	}
+	if tuning.preRotate {
 		rotate90(buf)
 	}
-	buf16 := make([]int16, len(buf))
+	buf16 := dongle.pool.get(len(buf))
 	for i := range buf {
 		buf16[i] = int16(buf[i]) - 127
 	}
 
-	dongle.lpChan <- buf16
+	if r.sessions.max > 0 {
+		r.sessions.tap(buf16, tuning)
+	}
+	r.queue(buf16)
 }
 
-// ReadAsync blocks until CancelAsync
-func dongleRoutine(wg *sync.WaitGroup) {
+// queue passes buf on to demodRoutine, or when it's fallen behind drops
+// either buf or the oldest buffer waiting
+func (r *Receiver) queue(buf []int16) {
+	dongle := r.dongle
+	now := time.Now()
+
+	select {
+	case dongle.lpChan <- buf:
+		r.reportOverruns(now)
+		return
+	default:
+	}
+
+	dropped := buf
+	if dongle.dropOldest {
+		select {
+		case dropped = <-dongle.lpChan:
+		default:
+			// demodRoutine has just caught up
+			dropped = nil
+		}
+		select {
+		case dongle.lpChan <- buf:
+		default:
+			dropped = buf
+		}
+	}
+	if dropped != nil {
+		r.overrun(now, len(dropped))
+		dongle.pool.put(dropped)
+	}
+	r.reportOverruns(now)
+}
+
+// overrun accounts for a dropped buffer of samples
+func (r *Receiver) overrun(now time.Time, samples int) {
+	dongle := r.dongle
+	if dongle.overruns == 0 {
+		dongle.overrunSince = now
+	}
+	dongle.overruns++
+	dongle.overrunSamples += samples
+
+	atomic.AddUint64(&r.metrics.dropped, 1)
+	atomic.AddUint64(&r.metrics.samplesDropped, uint64(samples))
+	atomic.StoreInt64(&r.metrics.lastOverrun, now.UnixNano())
+}
+
+// reportOverruns logs the overruns since the last report, at most once per
+// overrunReportInterval
+func (r *Receiver) reportOverruns(now time.Time) {
+	dongle := r.dongle
+	if dongle.overruns == 0 || now.Sub(dongle.overrunReported) < overrunReportInterval {
+		return
+	}
+	// samples are interleaved I and Q
+	lost := time.Duration(float64(dongle.overrunSamples/2) / float64(dongle.tuning().rate) * float64(time.Second))
+	r.logf("Overrun: dropped %d buffers (%s of samples) since %s\n",
+		dongle.overruns, lost.Round(time.Millisecond), dongle.overrunSince.Format("15:04:05.000"))
+	dongle.overruns = 0
+	dongle.overrunSamples = 0
+	dongle.overrunReported = now
+}
+
+// dongleRoutine reads from the dongle until the receiver is stopped,
+// reopening it should it drop off the bus
+func (r *Receiver) dongleRoutine(wg *sync.WaitGroup) {
 	defer wg.Done()
-	err := dongle.dev.ReadAsync(rtlsdrCallback, nil, 0, 0)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "ReadAsync failed, err %s\n", err)
+
+	// asyncCallback cancels the reads once stopped, but a stalled dongle
+	// makes no callbacks
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+		case <-done:
+			return
+		}
+		r.dongle.mu.RLock()
+		if r.dongle.dev != nil {
+			r.dongle.dev.CancelAsync()
+		}
+		r.dongle.mu.RUnlock()
+	}()
+
+	for r.ctx.Err() == nil {
+		err := r.readAsync(r.dongle.dev)
+		if r.ctx.Err() != nil {
+			break
+		}
+		// the reads only end of their own accord when the dongle is lost
+		if err == nil {
+			err = fmt.Errorf("reads ended")
+		}
+		atomic.AddUint64(&r.metrics.dropped, 1)
+		r.logf("ReadAsync failed, err %s\n", err)
+		if !r.reconnect(err) {
+			break
+		}
 	}
 
-	close(dongle.lpChan)
+	close(r.dongle.lpChan)
+	close(r.spectrum.iqChan)
+	r.sessions.closeAll()
 
-	fmt.Fprintf(os.Stderr, "Returning from dongleRoutine\n")
+	r.logf("Returning from dongleRoutine\n")
 }
 
-func demodRoutine(wg *sync.WaitGroup) {
+// demodRoutine runs until the dongle's buffers run out, or the receiver is
+// stopped; every send is abandoned on stopping, so an exited controller can't
+// leave it blocked.
+func (r *Receiver) demodRoutine(wg *sync.WaitGroup) {
+	var buf []int16
 	var ok bool
+	squelched := true
 
 	defer wg.Done()
 
-	for {
-		demod.lowpassed, ok = <-dongle.lpChan
+	demod, controller := r.demod, r.controller
+	frames := r.pipeline(wg, demod, r.output)
+	defer func() {
+		if frames != nil {
+			close(frames)
+		} else {
+			close(r.output.resultChan)
+		}
+		close(controller.hopChan)
+		close(r.search.levelChan)
+		r.logf("Returning from demodRoutine\n")
+	}()
 
-		if !ok {
-			close(output.resultChan)
-			close(controller.hopChan)
-			fmt.Fprintf(os.Stderr, "Returning from demodRoutine\n")
+	for {
+		select {
+		case buf, ok = <-r.dongle.lpChan:
+			if !ok {
+				return
+			}
+		case <-r.ctx.Done():
 			return
 		}
+		// filtered in place, shrinking lowpassed
+		demod.lowpassed = buf
+		if atomic.CompareAndSwapInt32(&controller.rearm, 1, 0) {
+			squelched = true
+		}
+
+		start := time.Now()
+		resetAGC := demod.frontEnd()
+		f := demodFrame{
+			buf:      buf,
+			pool:     r.dongle.pool,
+			samples:  demod.lowpassed,
+			settings: demod.backEndSettings(),
+			resetAGC: resetAGC,
+			output:   true,
+			freq:     controller.userFreq(controller.tunedFreq()),
+			took:     time.Since(start),
+			open:     demod.squelchLevel == 0 || demod.squelchHits == 0,
+		}
 
-		demod.fullDemod()
+		if r.search.enabled {
+			// only the level is wanted
+			r.metrics.demodTook(f.took)
+			r.dongle.pool.put(buf)
+			select {
+			case r.search.levelChan <- demod.level:
+			case <-r.ctx.Done():
+				return
+			}
+			continue
+		}
 
 		if demod.squelchLevel > 0 && demod.squelchHits > demod.conseqSquelch {
 			// hair trigger
 			demod.squelchHits = demod.conseqSquelch + 1
-			controller.hopChan <- true
-			continue
+			squelched = true
+			f.output = false
+			select {
+			case controller.hopChan <- true:
+			case <-r.ctx.Done():
+				return
+			}
+		} else if demod.squelchLevel > 0 && squelched && demod.squelchHits == 0 {
+			squelched = false
+			f.onset = true
+			select {
+			case controller.activeChan <- true:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		if !r.handOff(frames, demod, f, r.output) {
+			return
 		}
-		result := make([]int16, len(demod.lowpassed))
-		copy(result, demod.lowpassed)
-		output.resultChan <- result
 	}
 }
 
-func optimalSettings(freq int) {
+func optimalSettings(freq int, dongle *dongleState, demod *demodState) {
 	var captureFreq, captureRate int
 	demod.downsample = (minimumRate / demod.rateIn) + 1
 	captureFreq = freq
 	captureRate = demod.downsample * demod.rateIn
+	// offset tuning keeps the tuner's DC spike clear of the channel, otherwise
+	// capture a quarter of the rate above it and rotate it back down
 	if dongle.preRotate {
 		captureFreq = freq + captureRate/4
 	}
 
 	demod.outputScale = (1 << 15) / (128 * demod.downsample)
-	fmt.Fprintf(os.Stderr, "output scale %d\n", demod.outputScale)
 
 	if demod.outputScale < 1 {
 		demod.outputScale = 1
@@ -314,76 +574,326 @@ func optimalSettings(freq int) {
 	if reflect.ValueOf(demod.modeDemod).Pointer() == reflect.ValueOf(fmDemod).Pointer() {
 		demod.outputScale = 1
 	}
-	dongle.freq = uint32(captureFreq)
-	dongle.rate = uint32(captureRate)
+	dongle.setTuning(uint32(captureFreq), uint32(captureRate))
 }
 
-func controllerRoutine(wg *sync.WaitGroup) {
-	var err error
-	var lcmPost = [17]int{1, 1, 1, 3, 1, 5, 3, 7, 1, 9, 5, 11, 3, 13, 7, 15, 1}
-
-	defer wg.Done()
-
-	s := controller
-
-	if s.wbMode {
-		for i := range s.freqs {
-			s.freqs[i] += 16000
-		}
-	}
+// setup tunes the dongle to the primary channel and sets the sample rate
+func (r *Receiver) setup() (err error) {
+	dongle, demod, s := r.dongle, r.demod, r.controller
 
 	// set up primary channel
-	optimalSettings(int(s.freqs[0]))
+	optimalSettings(int(s.freqs[0]), dongle, demod)
+	r.logf("output scale %d\n", demod.outputScale)
 	demod.squelchLevel = squelchToRms(demod.squelchLevel, dongle, demod)
 
 	// Set the frequency
-	err = dongle.dev.SetCenterFreq(int(dongle.freq))
+	err = dongle.setCenterFreq()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", dongle.freq)
-		return
+		return fmt.Errorf("Error setting frequency %d", dongle.freq)
 	}
-
-	actualBufLen := lcmPost[demod.postDownsample] * defaultBufLen
-	fmt.Fprintf(os.Stderr, "Tuned to %d Hz\n", dongle.freq)
-	fmt.Fprintf(os.Stderr, "Oversampling input by: %dx.\n", demod.downsample)
-	fmt.Fprintf(os.Stderr, "Oversampling output by: %dx.\n", demod.postDownsample)
-	fmt.Fprintf(os.Stderr, "Buffer size: %0.2fms\n", 1000*0.5*float32(actualBufLen)/float32(dongle.rate))
+	s.windowCenter = s.freqs[0]
+	atomic.StoreInt64(&demod.tuneShift, 0)
+	s.mu.Lock()
+	s.tuned = s.freqs[0]
+	s.mu.Unlock()
+
+	r.logf("Tuned to %d Hz\n", dongle.freq)
+	r.logf("Oversampling input by: %dx.\n", demod.downsample)
+	r.logf("Oversampling output by: %dx.\n", demod.postDownsample)
+	r.logf("Buffer size: %0.2fms\n", 1000*0.5*float32(readLen)/float32(dongle.rate))
+	s.bufTime = time.Duration(float64(readLen/2) / float64(dongle.rate) * float64(time.Second))
 
 	// Set the sample rate
 	err = dongle.dev.SetSampleRate(int(dongle.rate))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error setting sample rate %d\n", dongle.rate)
+		return fmt.Errorf("Error setting sample rate %d", dongle.rate)
+	}
+	r.logf("Sampling at %d S/s.\n", dongle.rate)
+	r.logf("Output at %d Hz.\n", demod.rateIn/demod.postDownsample)
+	return
+}
+
+func (r *Receiver) controllerRoutine(wg *sync.WaitGroup) {
+	var err error
+
+	defer wg.Done()
+
+	s := r.controller
+
+	if err = r.setup(); err != nil {
+		r.logf("%s, stopping\n", err)
+		r.stop()
 		return
 	}
-	fmt.Fprintf(os.Stderr, "Sampling at %d S/s.\n", dongle.rate)
-	fmt.Fprintf(os.Stderr, "Output at %d Hz.\n", demod.rateIn/demod.postDownsample)
+
+	var priorityTick, dwellTick <-chan time.Time
+	if len(s.priority) > 0 {
+		ticker := time.NewTicker(s.priorityInterval)
+		defer ticker.Stop()
+		priorityTick = ticker.C
+	}
+	if s.dwell > 0 {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		dwellTick = ticker.C
+	}
+	s.lastQuiet = time.Now()
+
+	// start scanning
+	err = s.advance()
 
 	for {
-		_, ok := <-controller.hopChan
-		if !ok {
-			fmt.Fprintf(os.Stderr, "Returning from controllerRoutine\n")
+		if err != nil {
+			// most likely the dongle has been lost, which dongleRoutine
+			// recovers from
+			r.logf("Error setting frequency %d: %s\n", r.dongle.freq, err)
+			err = nil
+		}
+
+		select {
+		case _, ok := <-s.hopChan:
+			if !ok {
+				r.logf("Returning from controllerRoutine\n")
+				return
+			}
+
+			if !s.quiet(time.Now()) {
+				continue
+			}
+			err = s.advance()
+		case <-s.activeChan:
+			s.open(time.Now())
+		case now := <-dwellTick:
+			if !s.dwelt(now) {
+				continue
+			}
+			r.logf("Dwell time exceeded on %d Hz\n", s.current())
+			if !s.resume {
+				continue
+			}
+			err = s.advance()
+		case <-priorityTick:
+			if s.priorityNow >= 0 {
+				continue
+			}
+			err = s.checkPriority()
+			if err == nil && s.priorityNow >= 0 {
+				r.logf("Priority channel %d Hz active\n", s.current())
+			}
+		case fn := <-s.cmdChan:
+			fn()
+		case <-r.ctx.Done():
+			r.logf("Returning from controllerRoutine\n")
 			return
+		case <-s.lockChan:
+			if _, locked := s.lockedOut(s.current(), time.Now()); !locked {
+				continue
+			}
+			err = s.advance()
 		}
+	}
+}
+
+// command runs fn within controllerRoutine, serialising it with tuning
+func (s *controllerState) command(fn func() error) error {
+	reply := make(chan error, 1)
+	select {
+	case s.cmdChan <- func() { reply <- fn() }:
+	case <-time.After(commandTimeout):
+		return fmt.Errorf("Scanner isn't accepting commands")
+	}
+	return <-reply
+}
 
-		if len(s.freqs) <= 1 {
+// advance leaves the current channel, resuming the interrupted channel when
+// on a priority channel and otherwise moving on to the next in the scan list
+func (s *controllerState) advance() error {
+	if s.priorityNow < 0 && len(s.freqs) <= 1 {
+		return nil
+	}
+	s.activeSince = time.Time{}
+	s.quietSince = time.Time{}
+
+	if s.priorityNow >= 0 {
+		s.priorityNow = -1
+		return s.resumeScan()
+	}
+	return s.next(1)
+}
+
+// resumeScan returns to the scan list at the interrupted channel, or the one
+// after it should it have been locked out in the meantime
+func (s *controllerState) resumeScan() error {
+	return s.next(0)
+}
+
+// next tunes to the first channel of the scan list that isn't locked out,
+// counting from freqNow+from, staying put if that comes back round to freqNow
+func (s *controllerState) next(from int) error {
+	now := time.Now()
+	for i := from; i <= len(s.freqs); i++ {
+		next := (s.freqNow + i) % len(s.freqs)
+		if _, locked := s.lockedOut(s.freqs[next], now); locked {
 			continue
 		}
-		s.freqNow = (s.freqNow + 1) % len(s.freqs)
-		optimalSettings(int(s.freqs[s.freqNow]))
-		err = dongle.dev.SetCenterFreq(int(dongle.freq))
+		if next == s.freqNow && i > 0 {
+			return nil
+		}
+		s.freqNow = next
+		return s.tune(s.freqs[s.freqNow])
+	}
+	// every channel is locked out, stay where we are
+	return nil
+}
+
+// current returns the channel being monitored
+func (s *controllerState) current() uint32 {
+	if s.priorityNow >= 0 {
+		return s.priority[s.priorityNow]
+	}
+	return s.freqs[s.freqNow]
+}
+
+// settleTime is the longest demodRoutine takes to report on the squelch of a
+// freshly tuned channel
+func (s *controllerState) settleTime() time.Duration {
+	return time.Duration(s.demod.conseqSquelch+4) * s.bufTime
+}
+
+// markActive infers that the channel has been open since it was last reported
+// quiet when demodRoutine has stayed silent for longer than settleTime; open
+// channels are only reported on the transition from closed.
+func (s *controllerState) markActive(now time.Time) {
+	if s.activeSince.IsZero() && now.Sub(s.lastQuiet) > s.settleTime() {
+		s.activeSince = s.lastQuiet
+	}
+}
+
+// open records the channel opening at now
+func (s *controllerState) open(now time.Time) {
+	if s.activeSince.IsZero() {
+		s.activeSince = now
+	}
+	s.quietSince = time.Time{}
+}
+
+// quiet records demodRoutine asking to hop at now, reporting whether to leave
+// the channel: at once if it hasn't been active, otherwise once it has been
+// quiet for the hang time.
+func (s *controllerState) quiet(now time.Time) bool {
+	s.markActive(now)
+	s.lastQuiet = now
+	if s.activeSince.IsZero() {
+		return true
+	}
+	if s.quietSince.IsZero() {
+		s.quietSince = now
+	}
+	return now.Sub(s.quietSince) >= s.hang
+}
+
+// dwelt reports whether the channel has been active for the dwell time by
+// now, starting the next dwell if so
+func (s *controllerState) dwelt(now time.Time) bool {
+	s.markActive(now)
+	if s.activeSince.IsZero() || now.Sub(s.activeSince) < s.dwell {
+		return false
+	}
+	s.activeSince = now
+	return true
+}
+
+// tune moves to freq; digitally if it's within the capture bandwidth, and
+// otherwise by retuning the dongle, muting the samples captured whilst the
+// tuner settles
+func (s *controllerState) tune(freq uint32) error {
+	if s.inWindow(freq) {
+		atomic.StoreInt64(&s.demod.tuneShift, int64(s.windowCenter)-int64(freq))
+	} else {
+		optimalSettings(int(freq), s.dongle, s.demod)
+		err := s.dongle.setCenterFreq()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting frequency %d\n", dongle.freq)
-			return
+			return err
 		}
-		dongle.mute = bufferDump
+		atomic.StoreInt32(&s.dongle.mute, bufferDump)
+		s.windowCenter = freq
+		atomic.StoreInt64(&s.demod.tuneShift, 0)
 	}
+	s.lastQuiet = time.Now()
+	atomic.AddUint64(&s.metrics.hops, 1)
+
+	s.mu.Lock()
+	s.tuned = freq
+	s.mu.Unlock()
+	return nil
 }
 
-func outputRoutine(wg *sync.WaitGroup) {
-	var err error
+// inWindow reports whether freq lies far enough inside the capture bandwidth
+// of the dongle's current tuning to be reached digitally. The capture is
+// around the frequency the dongle is tuned to, which preRotate puts a quarter
+// of the sample rate above windowCenter, along with the DC spike.
+func (s *controllerState) inWindow(freq uint32) bool {
+	if !s.digitalTune || s.windowCenter == 0 {
+		return false
+	}
+	return s.dongle.tuning().reaches(freq, s.demod.rateIn)
+}
+
+// checkPriority briefly retunes to each priority channel in turn, staying on
+// the first one found active; otherwise the interrupted channel is resumed.
+func (s *controllerState) checkPriority() error {
+	now := time.Now()
+	for i, freq := range s.priority {
+		if _, locked := s.lockedOut(freq, now); locked {
+			continue
+		}
+		if err := s.tune(freq); err != nil {
+			return err
+		}
+		if s.probe() {
+			s.priorityNow = i
+			s.activeSince = time.Now()
+			s.quietSince = time.Time{}
+			return nil
+		}
+	}
+	return s.resumeScan()
+}
+
+// probe samples the squelch of a freshly tuned channel. Reports arriving
+// whilst the tuner settles belong to the previous channel and are ignored,
+// after which demodRoutine is rearmed to report the channel opening even if
+// it was already open. A channel which neither opens nor requests a hop
+// before the timeout is unknown, as demodRoutine has fallen behind, and is
+// treated as quiet so that the scan carries on.
+func (s *controllerState) probe() bool {
+	settle := time.After(2 * s.bufTime)
+	timeout := time.After(s.settleTime())
+	settled := false
 
+	for {
+		select {
+		case _, ok := <-s.hopChan:
+			if !ok || settled {
+				return false
+			}
+		case <-s.activeChan:
+			if settled {
+				return true
+			}
+		case <-settle:
+			settled = true
+			atomic.StoreInt32(&s.rearm, 1)
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func outputRoutine(wg *sync.WaitGroup, output *outputState) {
 	defer fmt.Fprintf(os.Stderr, "Returning from outputRoutine\n")
 	defer wg.Done()
+	defer output.closeSinks()
 
 	if output.pad {
 		startTime := time.Now()
@@ -392,15 +902,13 @@ func outputRoutine(wg *sync.WaitGroup) {
 		defer ticker.Stop()
 		for {
 			select {
-			case buf, ok := <-output.resultChan:
+			case c, ok := <-output.resultChan:
 				if !ok {
 					return
 				}
-				samples += int64(len(buf))
-				err = binary.Write(output.file, binary.LittleEndian, buf)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "output write error: %s\n", err)
-				}
+				samples += int64(len(c.buf))
+				output.write(c.buf, c.onset)
+				output.pool.put(c.buf)
 			case <-ticker.C:
 
 				samplesNow = int64((time.Since(startTime) * time.Duration(output.rate)) / time.Second)
@@ -408,38 +916,125 @@ func outputRoutine(wg *sync.WaitGroup) {
 				if samplesNow < samples {
 					continue
 				}
-				buf := make([]int16, samplesNow-samples)
-				err = binary.Write(output.file, binary.LittleEndian, buf)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "output write error: %s\n", err)
+				if gap := int(samplesNow - samples); cap(output.silence) < gap {
+					output.silence = make([]int16, gap)
 				}
+				output.write(output.silence[:samplesNow-samples], false)
 				samples = samplesNow
+			case <-output.abort:
+				output.finish()
+				return
 			}
 		}
 	} else {
 		for {
-			buf, ok := <-output.resultChan
-			if !ok {
+			select {
+			case c, ok := <-output.resultChan:
+				if !ok {
+					return
+				}
+				output.write(c.buf, c.onset)
+				output.pool.put(c.buf)
+			case <-output.abort:
+				output.finish()
 				return
 			}
+		}
+	}
+}
 
-			err = binary.Write(output.file, binary.LittleEndian, buf)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "output write error: %s\n", err)
-			}
+// finish closes the output for main, which has given up waiting for
+// resultChan to be closed
+func (o *outputState) finish() {
+	o.close()
+	close(o.aborted)
+}
+
+// begin starts the output file in the container of its codec: raw for PCM,
+// as sdrctl always has, WAV for ADPCM, and Ogg for Opus, which the encoder
+// writes itself
+func (o *outputState) begin() (err error) {
+	if o.enc, err = newEncoder(o.codec, o.rate, o.bitrate, o.logf); err != nil {
+		return
+	}
+	if o.codec == codecADPCM {
+		_, err = o.file.Write(wavHeader(o.codec, o.rate, wavStreaming, wavStreaming))
+	}
+	return
+}
+
+// write encodes buf to the output file, and passes it on to any sinks,
+// onset if it starts a transmission
+func (o *outputState) write(buf []int16, onset bool) {
+	o.bytes = o.enc.encode(o.bytes[:0], buf)
+	o.samples += uint32(len(buf))
+	o.writeBytes(o.bytes)
+	o.fanOut(buf, onset)
+}
+
+func (o *outputState) writeBytes(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	n, err := o.file.Write(b)
+	o.dataLen += uint32(n)
+	if err != nil {
+		atomic.AddUint64(&o.writeErrors, 1)
+		fmt.Fprintf(os.Stderr, "output write error: %s\n", err)
+	}
+}
+
+// close finishes the output file, completing the WAV header with its length,
+// and flushes it to disk, unless it's stdout
+func (o *outputState) close() {
+	if o.file == nil {
+		return
+	}
+	if o.enc != nil {
+		o.writeBytes(o.enc.flush(o.bytes[:0]))
+		o.enc = nil
+	}
+	if o.file == os.Stdout {
+		return
+	}
+	if o.codec == codecADPCM {
+		if _, err := o.file.WriteAt(wavHeader(o.codec, o.rate, o.dataLen, o.samples), 0); err != nil {
+			fmt.Fprintf(os.Stderr, "output header error: %s\n", err)
 		}
 	}
+	if err := o.file.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "output sync error: %s\n", err)
+	}
+	o.file.Close()
+	o.file = nil
 }
 
 func (d *demodState) fullDemod() {
+	d.backEnd(d.frontEnd())
+}
+
+// frontEnd mixes, filters and decimates lowpassed, then applies the squelch
+// and AFC; it returns whether backEnd should reset the AGC, as the squelch
+// has been closed for a while.
+func (d *demodState) frontEnd() (resetAGC bool) {
 	var i int
 	doSquelch := false
 
+	tuneShift := int(atomic.LoadInt64(&d.tuneShift))
+	if d.afcEnable || tuneShift != 0 {
+		if d.mix == nil {
+			d.mix = newMixer(0, d.rateIn*d.downsample)
+		}
+		d.mix.setShift(tuneShift+int(d.afcShift), d.rateIn*d.downsample)
+		d.mix.mix(d.lowpassed, d.lowpassed)
+	}
+
 	lowPass(d)
 
 	// power squelch
 	if d.squelchLevel > 0 {
 		sr := rms(d.lowpassed, 1)
+		d.level = sr
 		if sr < d.squelchLevel {
 			doSquelch = true
 		}
@@ -452,8 +1047,17 @@ func (d *demodState) fullDemod() {
 		}
 	} else {
 		d.squelchHits = 0
+		if d.afcEnable {
+			afc(d)
+		}
 	}
-	if d.squelchLevel > 0 && d.squelchHits > d.conseqSquelch {
+	return d.squelchLevel > 0 && d.squelchHits > d.conseqSquelch
+}
+
+// backEnd demodulates lowpassed, then applies the AGC, de-emphasis and any
+// final filtering
+func (d *demodState) backEnd(resetAGC bool) {
+	if resetAGC {
 		d.agc.gainNum = d.agc.gainDen
 	}
 
@@ -484,171 +1088,256 @@ func (f *frequencies) Set(val string) error {
 	return nil
 }
 
-func main() {
-	var err error
+// options are the settings of the process as a whole, rather than of a
+// receiver
+type options struct {
+	fs     *flag.FlagSet
+	list   bool
+	config string
+	http   string
+	extra  receiverArgs
+	// TLS certificate and key for the HTTP API, and its credentials file
+	tlsCert string
+	tlsKey  string
+	auth    string
+	creds   []credential
+	// longest to wait for the receivers to finish when stopping
+	shutdownTimeout time.Duration
+}
 
-	flag.IntVar(&dongle.devIndex, "d", 0, "dongle device index")
-	flag.Var(&controller.freqs, "f", "frequency or range of frequencies, and step e.g 92.9M:100.1M:25k")
-	flag.IntVar(&demod.squelchLevel, "l", 0, "squelch level")
-	rateStr := flag.String("s", "24k", "sample rate")
-	flag.IntVar(&dongle.ppmError, "p", 0, "ppm error")
-	flag.IntVar(&dongle.gain, "g", autoGain, "gain level (defaults to autogain)")
-	flag.BoolVar(&demod.agcEnable, "agc", false, "Software AGC")
-	flag.BoolVar(&output.pad, "pad", false, "pad output gaps with zeros")
-	demodMode := flag.String("M", "am", "demodulation mode [fm, wbfm, am]")
-
-	flag.Parse()
-
-	if *rateStr != "" {
-		var rateIn uint32
-		rateIn, err = freqHz(*rateStr)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to parse sample rate %s\n", err)
-			return
-		}
-		demod.rateIn = int(rateIn)
-		demod.rateOut = int(rateIn)
-	}
-
-	switch *demodMode {
-	case "fm":
-		demod.modeDemod = fmDemod
-	case "wbfm":
-		controller.wbMode = true
-		demod.modeDemod = fmDemod
-		demod.rateIn = 170000
-		demod.rateOut = 170000
-		demod.rateOut2 = 32000
-		output.rate = 32000
-		demod.customAtan = 1
-		//demod.post_downsample = 4;
-		demod.deemph = true
-		demod.squelchLevel = 0
-	default:
-		demod.modeDemod = amDemod
-	}
+// processFlags are the flags held in options
+var processFlags = map[string]bool{
+	"list":             true,
+	"config":           true,
+	"http":             true,
+	"receiver":         true,
+	"shutdown-timeout": true,
+	"tls-cert":         true,
+	"tls-key":          true,
+	"auth":             true,
+}
 
-	if len(controller.freqs) == 0 {
-		fmt.Fprintln(os.Stderr, "Please specify a frequency.")
-		flag.PrintDefaults()
-		return
+var errBadFlags = errors.New("Invalid flags")
+
+// parseArgs builds the receivers from the command line and configuration
+// file. The flags given as usual configure the first receiver, overriding
+// the first in the file, followed by the rest of the file's receivers and
+// then those added with -receiver.
+func parseArgs(args []string) (opts *options, rs []*Receiver, err error) {
+	opts = &options{}
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.BoolVar(&opts.list, "list", false, "list the attached dongles and exit")
+	fs.StringVar(&opts.config, "config", "", "configuration file, which flags given alongside it override")
+	fs.StringVar(&opts.http, "http", "", "address to serve the control API on e.g :8080 (defaults to disabled)")
+	fs.DurationVar(&opts.shutdownTimeout, "shutdown-timeout", 5*time.Second, "longest to wait for the receivers to finish when stopping")
+	fs.StringVar(&opts.tlsCert, "tls-cert", "", "certificate to serve the HTTP API over TLS with, given with -tls-key")
+	fs.StringVar(&opts.tlsKey, "tls-key", "", "private key of the -tls-cert certificate")
+	fs.StringVar(&opts.auth, "auth", "", "file of credentials the HTTP API requires, one \"role name secret\" to a line, role being listen or control (defaults to open)")
+	fs.Var(&opts.extra, "receiver", "an additional receiver, given its own flags and output file e.g \"-d 00000002 -f 446M loft.raw\"")
+	first := newReceiver()
+	first.flags(fs)
+	opts.fs = fs
+
+	if err = fs.Parse(args); err != nil {
+		return opts, nil, errBadFlags
 	}
-
-	if len(controller.freqs) >= frequenciesLimit {
-		fmt.Fprintf(os.Stderr, "Too many channels, maximum %d.\n", frequenciesLimit)
+	if opts.list {
 		return
 	}
 
-	if len(controller.freqs) > 1 && demod.squelchLevel == 0 {
-		fmt.Fprintln(os.Stderr, "Please specify a squelch level.  Required for scanning multiple frequencies.")
-		return
+	cfg := &configFile{global: configSection{}}
+	if opts.config != "" {
+		if cfg, err = loadConfig(opts.config); err != nil {
+			return
+		}
 	}
-
-	// quadruple sample_rate to limit to Δθ to ±π/2
-	demod.rateIn *= demod.postDownsample
-
-	if output.rate == 0 {
-		output.rate = demod.rateOut
+	if _, err = cfg.global.apply(fs, cfg.filename, true); err != nil {
+		return
 	}
 
-	if flag.Arg(0) != "" {
-		output.filename = flag.Arg(0)
-	} else {
-		output.filename = ""
+	sets := []*flag.FlagSet{fs}
+	outputs := [][]string{fs.Args()}
+	rs = append(rs, first)
+	for i, section := range cfg.receivers {
+		r, rfs := first, fs
+		if i > 0 {
+			r = newReceiver()
+			rfs = flag.NewFlagSet(fmt.Sprintf("receiver %d", i), flag.ContinueOnError)
+			r.flags(rfs)
+			rs = append(rs, r)
+			sets = append(sets, rfs)
+			outputs = append(outputs, nil)
+		}
+		var output string
+		if output, err = section.apply(rfs, cfg.filename, false); err != nil {
+			return
+		}
+		if output != "" && len(outputs[i]) == 0 {
+			outputs[i] = []string{output}
+		}
 	}
 
-	dongle.dev, err = rtl.Open(dongle.devIndex)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to open dongle, '%s', exiting\n", err)
-		return
+	for _, extra := range opts.extra {
+		r := newReceiver()
+		rfs := flag.NewFlagSet(fmt.Sprintf("receiver %d", len(rs)), flag.ContinueOnError)
+		r.flags(rfs)
+		if err = rfs.Parse(strings.Fields(extra)); err != nil {
+			return opts, nil, errBadFlags
+		}
+		rs = append(rs, r)
+		sets = append(sets, rfs)
+		outputs = append(outputs, rfs.Args())
 	}
-	defer dongle.dev.Close()
 
-	if demod.deemph {
-		demod.deemphA = int(
-			//round(1.0/(1.0-math.Exp(-1.0/(float64(demod.rateOut)*75e-6))), 0),
-			round(1.0 / (1.0 - math.Exp(-1.0/(float64(demod.rateOut)*75e-6)))),
-		)
-		fmt.Fprintf(os.Stderr, "Deempha %d\n", demod.deemphA)
-	}
-	// Set the tuner gain
-	if dongle.gain == autoGain {
-		fmt.Fprintf(os.Stderr, "Setting auto gain\n")
-		err = dongle.dev.SetTunerGainMode(false)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting tuner auto-gain: %s\n", err)
+	names := make(map[string]bool)
+	stdout := 0
+	for i, r := range rs {
+		if err = r.configure(outputs[i]); err != nil {
+			if err != errNoFrequency {
+				err = fmt.Errorf("Receiver %d: %s", i, err)
+			}
 			return
 		}
-	} else {
-		dongle.gain *= 10
-		dongle.gain, err = nearestGain(dongle.dev, dongle.gain)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error getting nearest gain to %d: %s\n", dongle.gain, err)
-			return
+		if r.name == "" {
+			r.name = strconv.Itoa(i)
 		}
-		err = dongle.dev.SetTunerGain(dongle.gain)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting tuner manual gain to %d: %s\n", dongle.gain)
-			return
+		if names[r.name] {
+			return opts, nil, fmt.Errorf("Receiver name '%s' is used more than once.", r.name)
+		}
+		names[r.name] = true
+		if r.output.filename == "" && !r.calibrateOnly {
+			stdout++
 		}
+		r.snapshot(sets[i])
+	}
+	if stdout > 1 {
+		return opts, nil, fmt.Errorf("Please specify output files.  Only one receiver may write to stdout.")
 	}
 
-	if dongle.ppmError > 0 {
-		err = dongle.dev.SetFreqCorrection(dongle.ppmError)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error setting frequency correction to %d: %s\n", dongle.ppmError, err)
-			return
+	if err = checkTLS(opts.tlsCert, opts.tlsKey); err != nil {
+		return
+	}
+	if opts.auth != "" {
+		if opts.creds, err = loadCredentials(opts.auth); err != nil {
+			return opts, nil, fmt.Errorf("Failed to load credentials: %s", err)
 		}
-		fmt.Fprintf(os.Stderr, "Tuner error set to %i ppm.\n", dongle.ppmError)
 	}
+	return
+}
 
-	if output.filename == "" {
-		output.file = os.Stdout
-	} else {
-		output.file, err = os.Create(output.filename)
-		if err != nil {
+func main() {
+	opts, rs, err := parseArgs(os.Args[1:])
+	if err != nil {
+		if err != errBadFlags {
 			fmt.Fprintln(os.Stderr, err)
-			return
 		}
-		defer output.file.Close()
+		if err == errNoFrequency {
+			opts.fs.PrintDefaults()
+		}
+		return
 	}
 
-	// Reset endpoint before we start reading from it (mandatory)
-	err = dongle.dev.ResetBuffer()
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	if opts.list {
+		listDevices()
 		return
 	}
+	receivers = rs
+	server.addr = opts.http
+	server.tlsCert, server.tlsKey = opts.tlsCert, opts.tlsKey
+	server.setCredentials(opts.creds)
+	if server.addr != "" && opts.creds != nil && server.tlsCert == "" {
+		fmt.Fprintf(os.Stderr, "Warning: credentials are sent in the clear without -tls-cert and -tls-key\n")
+	}
 
-	signalChan := make(chan os.Signal, 1)
-	quit := make(exitChan)
-	signal.Notify(signalChan, os.Interrupt)
-	go func() {
-		for _ = range signalChan {
-			fmt.Fprintln(os.Stderr, "\nReceived an interrupt, stopping services...")
-			close(quit)
+	running := 0
+	for _, r := range receivers {
+		defer r.close()
+		if err = r.open(); err != nil {
+			r.logf("%s, exiting\n", err)
 			return
 		}
+		if !r.calibrateOnly {
+			running++
+		}
+	}
+	if running == 0 {
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			reload(opts)
+		}
 	}()
 	var wg sync.WaitGroup
 
-	wg.Add(4)
+	if server.addr != "" {
+		server.srv = &http.Server{Addr: server.addr, Handler: server.authorize(server.routes())}
+		wg.Add(1)
+		go serverRoutine(&wg)
+	}
 
-	go controllerRoutine(&wg)
-	go outputRoutine(&wg)
-	go demodRoutine(&wg)
-	go dongleRoutine(&wg)
+	var started []*Receiver
+	for _, r := range receivers {
+		if !r.calibrateOnly {
+			r.start(ctx)
+			started = append(started, r)
+		}
+	}
 
-	controller.hopChan <- true
+	// receivers stop by themselves when they can't carry on
+	stopped := make(chan struct{})
+	go func() {
+		for _, r := range started {
+			r.wg.Wait()
+		}
+		close(stopped)
+	}()
 
-	<-quit
-	fmt.Fprintf(os.Stderr, "rtlsdr CancelAsync()\n")
-	if err := dongle.dev.CancelAsync(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error canceling async %s\n", err)
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr, "\nReceived a signal, stopping services...")
+	case <-stopped:
+		fmt.Fprintln(os.Stderr, "Every receiver has stopped, exiting...")
+	}
+	cancel()
+	for _, r := range started {
+		r.stop()
+	}
+	if server.srv != nil {
+		server.srv.Close()
 	}
 
 	fmt.Fprintf(os.Stderr, "Waiting for goroutines to finish...\n")
-	wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		<-stopped
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(opts.shutdownTimeout):
+		// the dongle can't be closed safely whilst it's being read, nor the
+		// output whilst outputRoutine writes it, so it's left to close that
+		fmt.Fprintf(os.Stderr, "Timed out after %s, exiting anyway\n", opts.shutdownTimeout)
+		deadline := time.After(abortTimeout)
+		for _, r := range started {
+			close(r.output.abort)
+		}
+		for _, r := range started {
+			select {
+			case <-r.output.aborted:
+			case <-deadline:
+			}
+		}
+		os.Exit(1)
+	}
 
 	fmt.Fprintf(os.Stderr, "Exiting...\n")
 }
@@ -0,0 +1,386 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFreqHz(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+	}{
+		{"90.2M", 90200000},
+		{"145.5m", 145500000},
+		{"446.00625M", 446006250},
+		{"446.19375M", 446193750},
+		{"128.0125M", 128012500},
+		{"128.075M", 128075000},
+		{"25K", 25000},
+		{"12.5k", 12500},
+		{"1.001k", 1001},
+		{"0.001M", 1000},
+	}
+	for _, tt := range tests {
+		got, err := freqHz(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("freqHz(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+
+	if _, err := freqHz("abcM"); err == nil {
+		t.Errorf("freqHz(\"abcM\") succeeded")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	const bufTime = 5 * time.Millisecond
+	tests := []struct {
+		name string
+		// demod stands in for demodRoutine, reporting on the channel
+		demod func(s *controllerState)
+		want  bool
+	}{
+		{"stalled", func(s *controllerState) {}, false},
+		{"opens", func(s *controllerState) {
+			for atomic.LoadInt32(&s.rearm) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			s.activeChan <- true
+		}, true},
+		{"quiet", func(s *controllerState) {
+			for atomic.LoadInt32(&s.rearm) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			s.hopChan <- true
+		}, false},
+		{"previous channel opens whilst settling", func(s *controllerState) {
+			s.activeChan <- true
+		}, false},
+		{"previous channel quiet whilst settling", func(s *controllerState) {
+			s.hopChan <- true
+			for atomic.LoadInt32(&s.rearm) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			s.activeChan <- true
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &controllerState{
+				bufTime:    bufTime,
+				demod:      &demodState{conseqSquelch: 2},
+				hopChan:    make(chan bool),
+				activeChan: make(chan bool),
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				tt.demod(s)
+			}()
+
+			start := time.Now()
+			if got := s.probe(); got != tt.want {
+				t.Errorf("probe() = %v, want %v", got, tt.want)
+			}
+			if took := time.Since(start); took > 2*s.settleTime() {
+				t.Errorf("probe() took %s, longer than settleTime %s", took, s.settleTime())
+			}
+			<-done
+		})
+	}
+}
+
+// TestDwellHang steps the scanner's dwell and hang timing through the
+// reports demodRoutine makes, and the ticks controllerRoutine gets
+func TestDwellHang(t *testing.T) {
+	type step struct {
+		event string
+		at    time.Duration
+		// whether a hop or tick moves on
+		want bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"quiet channel hops at once", []step{{"hop", 0, true}}},
+		{"held for the hang time", []step{
+			{"open", 0, false},
+			{"hop", time.Second, false},
+			{"hop", 2900 * time.Millisecond, false},
+			{"hop", 3 * time.Second, true},
+		}},
+		{"reopening restarts the hang time", []step{
+			{"open", 0, false},
+			{"hop", time.Second, false},
+			{"open", 2 * time.Second, false},
+			{"hop", 3500 * time.Millisecond, false},
+			{"hop", 5500 * time.Millisecond, true},
+		}},
+		{"dwell", []step{
+			{"open", 0, false},
+			{"tick", 4 * time.Second, false},
+			{"tick", 5 * time.Second, true},
+			// the next dwell starts
+			{"tick", 9 * time.Second, false},
+			{"tick", 10 * time.Second, true},
+		}},
+		// quiet channels ask to hop with every buffer
+		{"no dwell whilst quiet", []step{
+			{"hop", 0, true},
+			{"hop", 50 * time.Millisecond, true},
+			{"tick", 90 * time.Millisecond, false},
+			{"hop", 100 * time.Millisecond, true},
+			{"tick", 130 * time.Millisecond, false},
+		}},
+		// open channels are only reported on opening, so one which
+		// stays open after a hop is inferred to be active
+		{"open throughout", []step{
+			{"hop", 0, true},
+			{"tick", 6 * time.Second, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			s := &controllerState{
+				dwell:     5 * time.Second,
+				hang:      2 * time.Second,
+				bufTime:   10 * time.Millisecond,
+				demod:     &demodState{conseqSquelch: 2},
+				lastQuiet: start,
+			}
+			for _, st := range tt.steps {
+				now := start.Add(st.at)
+				var got bool
+				switch st.event {
+				case "open":
+					s.open(now)
+					continue
+				case "hop":
+					got = s.quiet(now)
+				case "tick":
+					got = s.dwelt(now)
+				}
+				if got != st.want {
+					t.Errorf("%s at %s = %t, want %t", st.event, st.at, got, st.want)
+				}
+			}
+		})
+	}
+}
+
+// TestInWindow checks channels are hopped to digitally only when they're
+// within the capture, which preRotate puts mostly above windowCenter
+func TestResumeScan(t *testing.T) {
+	const center = 145000000
+	freqs := []uint32{center, center + 25000, center + 50000}
+	const priority = center - 50000
+	tests := []struct {
+		name   string
+		locked []uint32
+		want   uint32
+	}{
+		{"resumes the interrupted channel", nil, freqs[1]},
+		{"skips it once locked out", []uint32{freqs[1]}, freqs[2]},
+		{"wraps around", []uint32{freqs[1], freqs[2]}, freqs[0]},
+		{"stays put when all are locked", freqs, priority},
+	}
+	for _, tt := range tests {
+		r := newReceiver()
+		r.demod.rateIn = 24000
+		r.controller.digitalTune = true
+		optimalSettings(center, r.dongle, r.demod)
+		r.controller.windowCenter = center
+
+		s := r.controller
+		s.freqs = freqs
+		s.priority = []uint32{priority}
+		s.freqNow = 1
+		for _, f := range tt.locked {
+			s.lockouts[f] = time.Time{}
+		}
+		if err := s.tune(priority); err != nil {
+			t.Fatal(err)
+		}
+		s.priorityNow = 0
+
+		if err := s.advance(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := s.tunedFreq(); got != tt.want {
+			t.Errorf("%s: tuned to %d, want %d", tt.name, got, tt.want)
+		}
+		if s.priorityNow != -1 {
+			t.Errorf("%s: still on priority channel %d", tt.name, s.priorityNow)
+		}
+	}
+}
+
+func TestOutputAbort(t *testing.T) {
+	for _, pad := range []bool{false, true} {
+		r := newReceiver()
+		r.output.pad = pad
+		f, err := os.CreateTemp(t.TempDir(), "out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.output.file = f
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go outputRoutine(&wg, r.output)
+
+		// resultChan is left open, as by a demodulator that's stuck
+		close(r.output.abort)
+		select {
+		case <-r.output.aborted:
+		case <-time.After(time.Second):
+			t.Fatalf("pad %t: outputRoutine didn't abort", pad)
+		}
+		wg.Wait()
+		if r.output.file != nil {
+			t.Errorf("pad %t: output left open", pad)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	const center = 145000000
+	tests := []struct {
+		preRotate bool
+		freq      uint32
+		want      bool
+	}{
+		// at 1008000 S/s, usable from 139200 Hz below windowCenter
+		{true, center, true},
+		{true, center + 100000, true},
+		{true, center - 100000, true},
+		{true, center - 139200, true},
+		{true, center - 139201, false},
+		{true, center - 300000, false},
+		{true, center - 391200, false},
+		// the DC spike, a quarter of the rate above
+		{true, center + 252000, false},
+		{true, center + 252000 + 23999, false},
+		{true, center + 252000 + 24000, true},
+		{true, center + 600000, true},
+		{true, center + 643200, true},
+		{true, center + 643201, false},
+		// offset tuning, centred on windowCenter and without a spike
+		{false, center - 391200, true},
+		{false, center - 391201, false},
+		{false, center + 252000, true},
+		{false, center + 600000, false},
+	}
+	for _, tt := range tests {
+		r := newReceiver()
+		r.demod.rateIn = 24000
+		r.dongle.preRotate = tt.preRotate
+		r.controller.digitalTune = true
+		optimalSettings(center, r.dongle, r.demod)
+		r.controller.windowCenter = center
+
+		if got := r.controller.inWindow(tt.freq); got != tt.want {
+			t.Errorf("preRotate %t: inWindow(%d), offset %d = %t, want %t",
+				tt.preRotate, tt.freq, int(tt.freq)-center, got, tt.want)
+		}
+	}
+}
+
+// benchReceiver configures a receiver as for an FM channel by default,
+// writing its audio to /dev/null
+func benchReceiver(b *testing.B) *Receiver {
+	r := newReceiver()
+	fs := flag.NewFlagSet("sdrctl", flag.ContinueOnError)
+	r.flags(fs)
+	if err := fs.Parse([]string{"-f", "145.5M", "-M", "fm"}); err != nil {
+		b.Fatal(err)
+	}
+	if err := r.configure(nil); err != nil {
+		b.Fatal(err)
+	}
+	optimalSettings(int(r.controller.freqs[0]), r.dongle, r.demod)
+
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { f.Close() })
+	r.output.file = f
+	if err = r.output.begin(); err != nil {
+		b.Fatal(err)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	b.Cleanup(r.cancel)
+	return r
+}
+
+// BenchmarkCallbackDemod passes a transfer from the dongle through
+// demodRoutine and outputRoutine, as each is read
+func BenchmarkCallbackDemod(b *testing.B) {
+	r := benchReceiver(b)
+	raw := make([]byte, readLen)
+	for i := range raw {
+		raw[i] = byte(127 + 50*(i%7-3))
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go r.demodRoutine(&wg)
+	go outputRoutine(&wg, r.output)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// as the dongle is paced by its sample rate, never overrun
+		for len(r.dongle.lpChan) == cap(r.dongle.lpChan) {
+			runtime.Gosched()
+		}
+		r.rtlsdrCallback(raw)
+	}
+	close(r.dongle.lpChan)
+	wg.Wait()
+}
+
+// BenchmarkOutputRoutine writes demodulated buffers, handed over as
+// demodRoutine does
+func BenchmarkOutputRoutine(b *testing.B) {
+	r := benchReceiver(b)
+	audio := make([]int16, readLen/2/r.demod.downsample)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go outputRoutine(&wg, r.output)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := r.output.pool.get(len(audio))
+		copy(buf, audio)
+		r.output.resultChan <- audioChunk{buf: buf}
+	}
+	close(r.output.resultChan)
+	wg.Wait()
+}
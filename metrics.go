@@ -0,0 +1,222 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricsState counts what a receiver's goroutines get up to, for /metrics.
+// The 64-bit counters come first to keep them aligned for atomic access on
+// 32-bit ARM.
+type metricsState struct {
+	buffers    uint64
+	dropped    uint64
+	hops       uint64
+	demodNanos uint64
+	demodCount uint64
+	// samples dropped when demodulation fell behind, and the last time it did
+	samplesDropped uint64
+	lastOverrun    int64
+	// math.Float64bits of the software AGC's gain
+	agcGain uint64
+
+	mu       sync.Mutex
+	channels map[uint32]*channelMetrics
+}
+
+type channelMetrics struct {
+	buffers uint64
+	open    uint64
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+func newMetrics() *metricsState {
+	m := &metricsState{channels: make(map[uint32]*channelMetrics)}
+	m.setAGCGain(1)
+	return m
+}
+
+// demodulated records a buffer demodulated for the channel freq, how long
+// that took, and whether its squelch was open
+func (m *metricsState) demodulated(freq uint32, took time.Duration, open bool) {
+	m.demodTook(took)
+
+	m.mu.Lock()
+	c, ok := m.channels[freq]
+	if !ok {
+		c = &channelMetrics{}
+		m.channels[freq] = c
+	}
+	c.buffers++
+	if open {
+		c.open++
+	}
+	m.mu.Unlock()
+}
+
+// demodTook records how long a buffer took to demodulate, where it wasn't
+// for a channel: a search steps through every frequency in its range, which
+// would each be kept
+func (m *metricsState) demodTook(took time.Duration) {
+	atomic.AddUint64(&m.demodNanos, uint64(took))
+	atomic.AddUint64(&m.demodCount, 1)
+}
+
+func (m *metricsState) setAGCGain(gain float64) {
+	atomic.StoreUint64(&m.agcGain, math.Float64bits(gain))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labels(pairs ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `%s="%s"`, pairs[i], labelEscaper.Replace(pairs[i+1]))
+	}
+	return b.String()
+}
+
+// writeMetric writes a family of samples in the Prometheus text format
+func writeMetric(w *bufio.Writer, name, kind, help string, samples []metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+	}
+}
+
+// perReceiver gathers a sample from each running receiver
+func perReceiver(value func(r *Receiver) float64) (samples []metricSample) {
+	for _, r := range receivers {
+		if r.calibrateOnly {
+			continue
+		}
+		samples = append(samples, metricSample{labels("receiver", r.name), value(r)})
+	}
+	return
+}
+
+// perChannel gathers a sample for each channel a receiver has demodulated
+func perChannel(value func(c channelMetrics) float64) (samples []metricSample) {
+	for _, r := range receivers {
+		m := r.metrics
+		m.mu.Lock()
+		freqs := make([]uint32, 0, len(m.channels))
+		for freq := range m.channels {
+			freqs = append(freqs, freq)
+		}
+		sort.Slice(freqs, func(i, j int) bool { return freqs[i] < freqs[j] })
+		for _, freq := range freqs {
+			samples = append(samples, metricSample{
+				labels("receiver", r.name, "freq", strconv.FormatUint(uint64(freq), 10)),
+				value(*m.channels[freq]),
+			})
+		}
+		m.mu.Unlock()
+	}
+	return
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	writeMetric(bw, "sdrctl_buffers_received_total", "counter", "Buffers read from the dongle.",
+		perReceiver(func(r *Receiver) float64 { return float64(atomic.LoadUint64(&r.metrics.buffers)) }))
+	writeMetric(bw, "sdrctl_buffers_dropped_total", "counter", "Buffers lost before demodulation.",
+		perReceiver(func(r *Receiver) float64 { return float64(atomic.LoadUint64(&r.metrics.dropped)) }))
+	writeMetric(bw, "sdrctl_samples_dropped_total", "counter", "Samples dropped whilst demodulation fell behind.",
+		perReceiver(func(r *Receiver) float64 { return float64(atomic.LoadUint64(&r.metrics.samplesDropped)) }))
+	writeMetric(bw, "sdrctl_last_overrun_timestamp_seconds", "gauge", "When demodulation last fell behind, or zero.",
+		perReceiver(func(r *Receiver) float64 { return float64(atomic.LoadInt64(&r.metrics.lastOverrun)) / 1e9 }))
+	writeMetric(bw, "sdrctl_demod_seconds", "summary", "Time spent demodulating each buffer.", nil)
+	for _, r := range receivers {
+		if r.calibrateOnly {
+			continue
+		}
+		l := labels("receiver", r.name)
+		fmt.Fprintf(bw, "sdrctl_demod_seconds_sum{%s} %g\n", l, float64(atomic.LoadUint64(&r.metrics.demodNanos))/1e9)
+		fmt.Fprintf(bw, "sdrctl_demod_seconds_count{%s} %d\n", l, atomic.LoadUint64(&r.metrics.demodCount))
+	}
+	writeMetric(bw, "sdrctl_channel_buffers_total", "counter", "Buffers demodulated per channel.",
+		perChannel(func(c channelMetrics) float64 { return float64(c.buffers) }))
+	writeMetric(bw, "sdrctl_channel_open_buffers_total", "counter", "Buffers demodulated per channel with the squelch open.",
+		perChannel(func(c channelMetrics) float64 { return float64(c.open) }))
+	writeMetric(bw, "sdrctl_squelch_open_ratio", "gauge", "Fraction of each channel's buffers with the squelch open, since starting.",
+		perChannel(func(c channelMetrics) float64 { return float64(c.open) / float64(c.buffers) }))
+	writeMetric(bw, "sdrctl_hops_total", "counter", "Channel changes made by the scanner.",
+		perReceiver(func(r *Receiver) float64 { return float64(atomic.LoadUint64(&r.metrics.hops)) }))
+	writeMetric(bw, "sdrctl_frequency_hz", "gauge", "Channel currently monitored.",
+		perReceiver(func(r *Receiver) float64 {
+			return float64(r.controller.userFreq(r.controller.tunedFreq()))
+		}))
+	writeMetric(bw, "sdrctl_center_frequency_hz", "gauge", "Frequency the dongle is tuned to.",
+		perReceiver(func(r *Receiver) float64 { return float64(r.dongle.tuning().freq) }))
+	writeMetric(bw, "sdrctl_tuner_gain_db", "gauge", "Tuner gain, or NaN when automatic.",
+		perReceiver(func(r *Receiver) float64 {
+			r.dongle.mu.RLock()
+			defer r.dongle.mu.RUnlock()
+			if r.dongle.gain == autoGain {
+				return math.NaN()
+			}
+			return float64(r.dongle.gain) / 10
+		}))
+	writeMetric(bw, "sdrctl_agc_gain", "gauge", "Gain applied by the software AGC.",
+		perReceiver(func(r *Receiver) float64 { return math.Float64frombits(atomic.LoadUint64(&r.metrics.agcGain)) }))
+	writeMetric(bw, "sdrctl_output_write_errors_total", "counter", "Failed writes to the output.",
+		perReceiver(func(r *Receiver) float64 {
+			errs := atomic.LoadUint64(&r.output.writeErrors)
+			for _, ch := range r.channelizer.channels {
+				errs += atomic.LoadUint64(&ch.output.writeErrors)
+			}
+			return float64(errs)
+		}))
+	writeMetric(bw, "sdrctl_demod_backlog_buffers", "gauge", "Buffers waiting to be demodulated.",
+		perReceiver(func(r *Receiver) float64 { return float64(len(r.dongle.lpChan)) }))
+	writeMetric(bw, "sdrctl_output_backlog_buffers", "gauge", "Buffers waiting to be written to the output.",
+		perReceiver(func(r *Receiver) float64 { return float64(len(r.output.resultChan)) }))
+	writeMetric(bw, "sdrctl_device_streaming", "gauge", "Whether the dongle is streaming, rather than being reconnected.",
+		perReceiver(func(r *Receiver) float64 {
+			r.dongle.mu.RLock()
+			defer r.dongle.mu.RUnlock()
+			if r.dongle.health == healthStreaming {
+				return 1
+			}
+			return 0
+		}))
+	writeMetric(bw, "sdrctl_device_reconnects_total", "counter", "Times the dongle has been reopened after dropping off the bus.",
+		perReceiver(func(r *Receiver) float64 {
+			r.dongle.mu.RLock()
+			defer r.dongle.mu.RUnlock()
+			return float64(r.dongle.reconnects)
+		}))
+}
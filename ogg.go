@@ -0,0 +1,105 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import "encoding/binary"
+
+const (
+	oggHeaderLen = 27
+	oggBOS       = 2
+	oggEOS       = 4
+	// most lacing values, and so whole packets of 255 bytes, in a page
+	oggMaxSegments = 255
+)
+
+// CRC-32 of Ogg pages: polynomial 0x04c11db7, unreflected, starting at 0
+var oggCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return
+}()
+
+func oggCRC(b []byte) (crc uint32) {
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return
+}
+
+// oggStream gathers the packets of a logical bitstream into pages (RFC
+// 3533). Packets never span pages.
+type oggStream struct {
+	serial  uint32
+	seq     uint32
+	granule int64
+	packets int
+	lacing  []byte
+	body    []byte
+}
+
+// fits is whether a packet of n bytes can join the page being built
+func (s *oggStream) fits(n int) bool {
+	return len(s.lacing)+n/255+1 <= oggMaxSegments
+}
+
+// packet adds p to the page being built, its last sample being granule
+func (s *oggStream) packet(p []byte, granule int64) {
+	n := len(p)
+	for ; n >= 255; n -= 255 {
+		s.lacing = append(s.lacing, 255)
+	}
+	s.lacing = append(s.lacing, byte(n))
+	s.body = append(s.body, p...)
+	s.granule = granule
+	s.packets++
+}
+
+// page appends the page built so far to dst, the last of the stream if
+// eos is set
+func (s *oggStream) page(dst []byte, eos bool) []byte {
+	start := len(dst)
+	var h [oggHeaderLen]byte
+	copy(h[:], "OggS")
+	if s.seq == 0 {
+		h[5] |= oggBOS
+	}
+	if eos {
+		h[5] |= oggEOS
+	}
+	le := binary.LittleEndian
+	le.PutUint64(h[6:], uint64(s.granule))
+	le.PutUint32(h[14:], s.serial)
+	le.PutUint32(h[18:], s.seq)
+	h[26] = byte(len(s.lacing))
+	dst = append(dst, h[:]...)
+	dst = append(dst, s.lacing...)
+	dst = append(dst, s.body...)
+	le.PutUint32(dst[start+22:], oggCRC(dst[start:]))
+
+	s.seq++
+	s.packets = 0
+	s.lacing = s.lacing[:0]
+	s.body = s.body[:0]
+	return dst
+}
@@ -0,0 +1,94 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestOggCRC(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+	}{
+		{"", 0},
+		{"123456789", 0x89a1897f},
+	}
+	for _, tt := range tests {
+		if got := oggCRC([]byte(tt.in)); got != tt.want {
+			t.Errorf("oggCRC(%q) = %#x, want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestOggPage(t *testing.T) {
+	tests := []struct {
+		sizes  []int
+		eos    bool
+		lacing []byte
+	}{
+		{[]int{19}, false, []byte{19}},
+		{[]int{0}, true, []byte{0}},
+		{[]int{100, 255, 300}, false, []byte{100, 255, 0, 255, 45}},
+		{[]int{510}, true, []byte{255, 255, 0}},
+	}
+	s := oggStream{serial: 0x12345678}
+	for seq, tt := range tests {
+		var body []byte
+		for i, n := range tt.sizes {
+			p := bytes.Repeat([]byte{byte(seq*16 + i)}, n)
+			body = append(body, p...)
+			s.packet(p, int64(seq*1000+i))
+		}
+		page := s.page([]byte("prefix"), tt.eos)
+		if string(page[:6]) != "prefix" {
+			t.Fatalf("page %d overwrote what it was appended to", seq)
+		}
+		page = page[6:]
+
+		le := binary.LittleEndian
+		var flags byte
+		if seq == 0 {
+			flags |= oggBOS
+		}
+		if tt.eos {
+			flags |= oggEOS
+		}
+		granule := int64(seq*1000 + len(tt.sizes) - 1)
+		if string(page[:4]) != "OggS" || page[4] != 0 || page[5] != flags ||
+			int64(le.Uint64(page[6:])) != granule || le.Uint32(page[14:]) != s.serial || le.Uint32(page[18:]) != uint32(seq) {
+			t.Errorf("page %d header %x", seq, page[:oggHeaderLen])
+		}
+		if n := int(page[26]); !bytes.Equal(page[oggHeaderLen:oggHeaderLen+n], tt.lacing) {
+			t.Errorf("page %d lacing %v, want %v", seq, page[oggHeaderLen:oggHeaderLen+n], tt.lacing)
+		}
+		if got := page[oggHeaderLen+len(tt.lacing):]; !bytes.Equal(got, body) {
+			t.Errorf("page %d body of %d bytes, want %d", seq, len(got), len(body))
+		}
+		crc := le.Uint32(page[22:])
+		le.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Errorf("page %d CRC %#x, want %#x", seq, crc, oggCRC(page))
+		}
+	}
+
+	// a page holds at most 255 lacing values
+	s.packet(make([]byte, 253*255), 0)
+	if !s.fits(254) || s.fits(255) {
+		t.Errorf("with %d lacing values, fits(254) = %t, fits(255) = %t", len(s.lacing), s.fits(254), s.fits(255))
+	}
+}
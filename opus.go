@@ -0,0 +1,305 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+/*
+#cgo LDFLAGS: -lopus
+#include <opus/opus.h>
+
+// opus_encoder_ctl is variadic, which cgo can't call
+static int set_bitrate(OpusEncoder *st, opus_int32 bitrate) {
+	return opus_encoder_ctl(st, OPUS_SET_BITRATE(bitrate));
+}
+
+static int set_vbr(OpusEncoder *st, opus_int32 vbr) {
+	return opus_encoder_ctl(st, OPUS_SET_VBR(vbr));
+}
+
+static int get_lookahead(OpusEncoder *st, opus_int32 *samples) {
+	return opus_encoder_ctl(st, OPUS_GET_LOOKAHEAD(samples));
+}
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+const (
+	opusRate = 48000
+	// samples in a packet of 20ms, at 48kHz as Ogg counts them
+	opusFrame = opusRate / 50
+	// largest packet of a single frame
+	opusMaxPacket      = 1275
+	opusMinBitrate     = 6000
+	opusMaxBitrate     = 256000
+	opusDefaultBitrate = 16000
+	// packets in an Ogg page, 200ms of audio, unless synced sooner
+	oggOpusPagePackets = 10
+)
+
+// the rates libopus encodes at, audio being resampled up to the next
+var opusRates = []int{8000, 12000, 16000, 24000, 48000}
+
+// opusEncoder codes mono audio through libopus as packets of one 20ms
+// frame each, at a constant bitrate: the framing is left to the container,
+// or to the messages of a network stream. libopus chooses the bandwidth,
+// as wide as the bitrate allows, but no wider than the audio.
+type opusEncoder struct {
+	// the encoder's state, which holds no pointers, so may live in Go's
+	// memory rather than be freed; as words, to be aligned
+	state     []uint64
+	resampler *resampler
+	upsample  int
+	// samples the decoder discards from the start, at 48kHz, being the
+	// encoder's lookahead
+	preSkip   int
+	packet    []byte
+	pending   []int16
+	resampled []int16
+	// samples coded, at 48kHz, not counting padding
+	samples int64
+}
+
+func newOpusEncoder(rate, bitrate int) (*opusEncoder, error) {
+	if bitrate < opusMinBitrate || bitrate > opusMaxBitrate {
+		return nil, fmt.Errorf("Opus bitrate must be between %d and %d bits/s.", opusMinBitrate, opusMaxBitrate)
+	}
+
+	in := opusRates[len(opusRates)-1]
+	for _, r := range opusRates {
+		if r >= rate {
+			in = r
+			break
+		}
+	}
+
+	size := int(C.opus_encoder_get_size(1))
+	e := &opusEncoder{
+		state:    make([]uint64, (size+7)/8),
+		upsample: opusRate / in,
+		packet:   make([]byte, opusMaxPacket),
+		pending:  make([]int16, 0, in/50),
+	}
+	st := e.st()
+	if err := opusError(C.opus_encoder_init(st, C.opus_int32(in), 1, C.OPUS_APPLICATION_VOIP)); err != nil {
+		return nil, err
+	}
+	if err := opusError(C.set_bitrate(st, C.opus_int32(bitrate))); err != nil {
+		return nil, err
+	}
+	// constant, as the links it's for are
+	if err := opusError(C.set_vbr(st, 0)); err != nil {
+		return nil, err
+	}
+	var lookahead C.opus_int32
+	if err := opusError(C.get_lookahead(st, &lookahead)); err != nil {
+		return nil, err
+	}
+	e.preSkip = int(lookahead) * e.upsample
+
+	if rate != in {
+		e.resampler = newResampler(rate, in)
+	}
+	return e, nil
+}
+
+func (e *opusEncoder) st() *C.OpusEncoder {
+	return (*C.OpusEncoder)(unsafe.Pointer(&e.state[0]))
+}
+
+func opusError(i C.int) error {
+	if i < 0 {
+		return fmt.Errorf("Opus error: %s", C.GoString(C.opus_strerror(i)))
+	}
+	return nil
+}
+
+// packets encodes buf, calling send with each packet completed; the packet
+// is reused once send returns. A packet libopus fails to code is dropped,
+// the first such failure being returned once the rest are sent.
+func (e *opusEncoder) packets(buf []int16, send func([]byte)) (err error) {
+	if e.resampler != nil {
+		e.resampled = e.resampler.resample(e.resampled[:0], buf)
+		buf = e.resampled
+	}
+	e.samples += int64(len(buf) * e.upsample)
+	for len(buf) > 0 {
+		n := minInt(cap(e.pending)-len(e.pending), len(buf))
+		e.pending = append(e.pending, buf[:n]...)
+		buf = buf[n:]
+		if len(e.pending) < cap(e.pending) {
+			continue
+		}
+		p, ferr := e.frame()
+		if ferr != nil {
+			if err == nil {
+				err = ferr
+			}
+			continue
+		}
+		send(p)
+	}
+	return
+}
+
+// flushPackets pads out any part frame with silence, and sends it
+func (e *opusEncoder) flushPackets(send func([]byte)) error {
+	if len(e.pending) == 0 {
+		return nil
+	}
+	p, err := e.silence()
+	if err != nil {
+		return err
+	}
+	send(p)
+	return nil
+}
+
+// silence pads the pending samples out to a frame with silence, coding it
+func (e *opusEncoder) silence() ([]byte, error) {
+	for len(e.pending) < cap(e.pending) {
+		e.pending = append(e.pending, 0)
+	}
+	return e.frame()
+}
+
+// frame codes the pending samples as a packet, which are dropped should
+// libopus fail. It only fails given arguments it can't take, which
+// newOpusEncoder ought to have ruled out.
+func (e *opusEncoder) frame() ([]byte, error) {
+	n := C.opus_encode(e.st(), (*C.opus_int16)(unsafe.Pointer(&e.pending[0])), C.int(len(e.pending)),
+		(*C.uchar)(unsafe.Pointer(&e.packet[0])), C.opus_int32(len(e.packet)))
+	e.pending = e.pending[:0]
+	if err := opusError(C.int(n)); err != nil {
+		return nil, err
+	}
+	return e.packet[:n], nil
+}
+
+// oggOpusEncoder writes Opus in Ogg (RFC 7845), as files and HTTP streams
+// are played. Pages are held until full, so a stream that pauses should be
+// synced to send on what it has.
+type oggOpusEncoder struct {
+	opus  *opusEncoder
+	rate  int
+	ogg   oggStream
+	begun bool
+	// the stream's TITLE comment, if set before it's begun
+	title string
+	// the page being appended to whilst packets are sent
+	out []byte
+	// reports packets dropped, as libopus failed to code them
+	logf func(format string, a ...interface{})
+}
+
+func newOggOpusEncoder(rate, bitrate int, logf func(format string, a ...interface{})) (*oggOpusEncoder, error) {
+	opus, err := newOpusEncoder(rate, bitrate)
+	if err != nil {
+		return nil, err
+	}
+	e := &oggOpusEncoder{opus: opus, rate: rate, logf: logf}
+	e.ogg.serial = uint32(time.Now().UnixNano())
+	return e, nil
+}
+
+func (e *oggOpusEncoder) encode(dst []byte, buf []int16) []byte {
+	e.out = e.begin(dst)
+	if err := e.opus.packets(buf, e.add); err != nil {
+		e.logf("Dropped Opus audio, '%s'\n", err)
+	}
+	dst, e.out = e.out, nil
+	return dst
+}
+
+// sync writes out the headers, and any packets held in the page
+func (e *oggOpusEncoder) sync(dst []byte) []byte {
+	dst = e.begin(dst)
+	if e.ogg.packets > 0 {
+		dst = e.ogg.page(dst, false)
+	}
+	return dst
+}
+
+// flush ends the stream, coding out what the encoder's lookahead holds
+// back, and trimming the padding of its last packet
+func (e *oggOpusEncoder) flush(dst []byte) []byte {
+	e.out = e.begin(dst)
+	err := e.opus.flushPackets(e.add)
+	end := int64(e.opus.preSkip) + e.opus.samples
+	for err == nil && (e.ogg.packets == 0 || e.ogg.granule < end) {
+		// the last page must end a packet, too
+		var p []byte
+		if p, err = e.opus.silence(); err == nil {
+			e.add(p)
+		}
+	}
+	if err != nil {
+		e.logf("Dropped the end of the Opus stream, '%s'\n", err)
+	}
+	if end < e.ogg.granule {
+		e.ogg.granule = end
+	}
+	dst = e.ogg.page(e.out, true)
+	e.out = nil
+	return dst
+}
+
+// add puts a packet in the page, first writing out the page if it's full
+func (e *oggOpusEncoder) add(p []byte) {
+	if e.ogg.packets == oggOpusPagePackets || !e.ogg.fits(len(p)) {
+		e.out = e.ogg.page(e.out, false)
+	}
+	e.ogg.packet(p, e.ogg.granule+opusFrame)
+}
+
+// begin writes the identification and comment headers, each on its own page
+func (e *oggOpusEncoder) begin(dst []byte) []byte {
+	if e.begun {
+		return dst
+	}
+	e.begun = true
+
+	le := binary.LittleEndian
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1 // version
+	head[9] = 1 // channels
+	le.PutUint16(head[10:], uint16(e.opus.preSkip))
+	le.PutUint32(head[12:], uint32(e.rate))
+	// no output gain, and the mono/stereo channel mapping
+	e.ogg.packet(head, 0)
+	dst = e.ogg.page(dst, false)
+
+	vendor := "sdrctl"
+	var comments []string
+	if e.title != "" {
+		comments = append(comments, "TITLE="+e.title)
+	}
+	tags := append([]byte("OpusTags"), 0, 0, 0, 0)
+	le.PutUint32(tags[8:], uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = append(tags, byte(len(comments)), 0, 0, 0)
+	for _, c := range comments {
+		tags = append(tags, 0, 0, 0, 0)
+		le.PutUint32(tags[len(tags)-4:], uint32(len(c)))
+		tags = append(tags, c...)
+	}
+	e.ogg.packet(tags, 0)
+	return e.ogg.page(dst, false)
+}
@@ -0,0 +1,210 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testSignal is a few tones and some noise, at rate
+func testSignal(rate, n int) []int16 {
+	rnd := rand.New(rand.NewSource(1))
+	pcm := make([]int16, n)
+	for i := range pcm {
+		t := float64(i) / float64(rate)
+		s := 6000*math.Sin(2*math.Pi*440*t) + 3000*math.Sin(2*math.Pi*1270*t) +
+			1500*math.Sin(2*math.Pi*float64(rate)*0.3*t) + 300*rnd.NormFloat64()
+		pcm[i] = int16(s)
+	}
+	return pcm
+}
+
+// oggPackets splits an Ogg stream into its packets, checking each page
+func oggPackets(t *testing.T, b []byte) (packets [][]byte, granules []int64, flags []byte) {
+	var packet []byte
+	for len(b) > 0 {
+		if len(b) < oggHeaderLen || string(b[:4]) != "OggS" {
+			t.Fatalf("no page at %d bytes from the end", len(b))
+		}
+		n := int(b[26])
+		size := oggHeaderLen + n
+		for _, l := range b[oggHeaderLen : oggHeaderLen+n] {
+			size += int(l)
+		}
+		page := append([]byte(nil), b[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		if oggCRC(page) != crc {
+			t.Fatalf("page %d has a bad CRC", len(flags))
+		}
+		flags = append(flags, b[5])
+		granules = append(granules, int64(binary.LittleEndian.Uint64(b[6:])))
+
+		body := b[oggHeaderLen+n : size]
+		for _, l := range b[oggHeaderLen : oggHeaderLen+n] {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		b = b[size:]
+	}
+	if packet != nil {
+		t.Fatal("stream ends part way through a packet")
+	}
+	return
+}
+
+// opusFrameTime is the duration, in 48kHz samples, of the frames of an Opus
+// packet given its TOC byte (RFC 6716 section 3.1), and whether it's a
+// single mono frame
+func opusFrameTime(toc byte) (samples int, single bool) {
+	config := int(toc >> 3)
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40 or 60ms
+		samples = []int{480, 960, 1920, 2880}[config%4]
+	case config < 16:
+		// hybrid: 10 or 20ms
+		samples = []int{480, 960}[config%2]
+	default:
+		// CELT: 2.5, 5, 10 or 20ms
+		samples = []int{120, 240, 480, 960}[config%4]
+	}
+	return samples, toc&0x7 == 0
+}
+
+func TestOggOpus(t *testing.T) {
+	tests := []struct {
+		rate, bitrate int
+		samples       int
+		// rate the audio is coded at
+		in int
+	}{
+		{8000, 16000, 8000, 8000},
+		{8000, 6000, 100, 8000},
+		{11025, 16000, 11025, 12000},
+		{12000, 16000, 12000, 12000},
+		{22050, 32000, 22050, 24000},
+		{24000, 64000, 4000, 24000},
+		{32000, 64000, 32000, 48000},
+		{48000, 64000, 48000, 48000},
+		{8000, 16000, 0, 8000},
+	}
+	for _, tt := range tests {
+		enc, err := newEncoder(codecOpus, tt.rate, tt.bitrate, t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opus := enc.(*oggOpusEncoder).opus
+		if opus.upsample != opusRate/tt.in || cap(opus.pending) != tt.in/50 {
+			t.Errorf("%d Hz: coded at %d Hz, want %d Hz", tt.rate, opusRate/opus.upsample, tt.in)
+		}
+		if opus.preSkip <= 0 {
+			t.Errorf("%d Hz: pre-skip %d", tt.rate, opus.preSkip)
+		}
+
+		b := enc.sync(nil)
+		pcm := testSignal(tt.rate, tt.samples)
+		for len(pcm) > 0 {
+			n := minInt(len(pcm), 1000)
+			b = enc.encode(b, pcm[:n])
+			pcm = pcm[n:]
+		}
+		b = enc.flush(b)
+
+		packets, granules, flags := oggPackets(t, b)
+		if flags[0] != oggBOS || flags[len(flags)-1] != oggEOS {
+			t.Errorf("%d Hz: pages flagged %v", tt.rate, flags)
+		}
+		for i, g := range granules[2 : len(granules)-1] {
+			if g%opusFrame != 0 || g == 0 {
+				t.Errorf("%d Hz: page %d ends at granule %d, not a whole packet", tt.rate, i+2, g)
+			}
+		}
+		// the audio, resampled to 48kHz, then the lookahead to be skipped
+		end := granules[len(granules)-1]
+		if want := int64(opus.preSkip) + opus.samples; end != want {
+			t.Errorf("%d Hz: last granule %d, want %d", tt.rate, end, want)
+		}
+		if coded := int64(tt.samples) * opusRate / int64(tt.rate); opus.samples < coded-opusFrame || opus.samples > coded+opusFrame {
+			t.Errorf("%d Hz: %d samples coded, want about %d", tt.rate, opus.samples, coded)
+		}
+
+		head := packets[0]
+		le := binary.LittleEndian
+		if string(head[:8]) != "OpusHead" || len(head) != 19 || head[9] != 1 ||
+			int(le.Uint16(head[10:])) != opus.preSkip || le.Uint32(head[12:]) != uint32(tt.rate) {
+			t.Errorf("%d Hz: OpusHead %x", tt.rate, head)
+		}
+		if string(packets[1][:8]) != "OpusTags" {
+			t.Errorf("%d Hz: no OpusTags", tt.rate)
+		}
+		audio := packets[2:]
+		if want := int(end+opusFrame-1) / opusFrame; len(audio) != want {
+			t.Errorf("%d Hz: %d packets, want %d", tt.rate, len(audio), want)
+		}
+		for i, p := range audio {
+			if samples, single := opusFrameTime(p[0]); samples != opusFrame || !single {
+				t.Fatalf("%d Hz: packet %d TOC %#x, not a single mono 20ms frame", tt.rate, i, p[0])
+			}
+			// constant bitrate
+			if len(p) != tt.bitrate/400 {
+				t.Fatalf("%d Hz: packet %d of %d bytes, want %d", tt.rate, i, len(p), tt.bitrate/400)
+			}
+		}
+	}
+}
+
+func TestOpusBitrate(t *testing.T) {
+	for _, bitrate := range []int{0, opusMinBitrate - 1, opusMaxBitrate + 1} {
+		if _, err := newOpusEncoder(24000, bitrate); err == nil {
+			t.Errorf("newOpusEncoder(24000, %d) succeeded", bitrate)
+		}
+	}
+}
+
+func TestOpusDropsFailedPackets(t *testing.T) {
+	var logged int
+	enc, err := newOggOpusEncoder(24000, 16000, func(format string, a ...interface{}) {
+		logged++
+		t.Logf(format, a...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a frame size libopus refuses, so that every packet fails
+	enc.opus.pending = make([]int16, 0, 7)
+
+	b := enc.encode(nil, testSignal(24000, 100))
+	if logged != 1 {
+		t.Errorf("encode logged %d failures, want 1", logged)
+	}
+	// ends, rather than padding out the stream forever
+	b = enc.flush(b)
+	if logged != 2 {
+		t.Errorf("flush logged %d failures, want 2", logged)
+	}
+
+	packets, _, flags := oggPackets(t, b)
+	if len(packets) != 2 || flags[len(flags)-1] != oggEOS {
+		t.Errorf("%d packets, pages flagged %v; want the headers alone, ended", len(packets), flags)
+	}
+}
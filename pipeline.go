@@ -0,0 +1,152 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// demodFrame is a buffer passed from the front end of a demodulator, which
+// mixes, filters and squelches it, to the back end which demodulates it.
+//
+// With -pipeline the back end runs on a goroutine of its own, so a second core
+// shares the work. Frames pass through a single channel, so stay in order, and
+// each end keeps its own filter state: the front end in the demodState it was
+// configured with, the back end in a copy taken before the first frame. The
+// settings travel with each frame, so the back end follows any change made
+// to the front end's.
+type demodFrame struct {
+	// buf is returned to pool once demodulated, samples is what remains of
+	// it after the front end
+	buf     []int16
+	pool    *bufferPool
+	samples []int16
+
+	settings backEndSettings
+	resetAGC bool
+	// false whilst squelched, when the back end only keeps its state current
+	output bool
+	// the squelch has just opened, starting a transmission
+	onset bool
+
+	// for metrics
+	freq uint32
+	took time.Duration
+	open bool
+}
+
+// backEndSettings are the settings of a demodState read by its back end
+type backEndSettings struct {
+	modeDemod   func(fm *demodState)
+	outputScale int
+	customAtan  int
+	agcEnable   bool
+	deemph      bool
+	deemphA     int
+	rateOut     int
+	rateOut2    int
+}
+
+func (d *demodState) backEndSettings() backEndSettings {
+	return backEndSettings{
+		modeDemod:   d.modeDemod,
+		outputScale: d.outputScale,
+		customAtan:  d.customAtan,
+		agcEnable:   d.agcEnable,
+		deemph:      d.deemph,
+		deemphA:     d.deemphA,
+		rateOut:     d.rateOut,
+		rateOut2:    d.rateOut2,
+	}
+}
+
+func (d *demodState) setBackEnd(s backEndSettings) {
+	d.modeDemod = s.modeDemod
+	d.outputScale = s.outputScale
+	d.customAtan = s.customAtan
+	d.agcEnable = s.agcEnable
+	d.deemph = s.deemph
+	d.deemphA = s.deemphA
+	d.rateOut = s.rateOut
+	d.rateOut2 = s.rateOut2
+}
+
+// handOff passes f to the back end, on frames if pipelined or otherwise
+// demodulating it on d in place; false once the receiver is stopped.
+func (r *Receiver) handOff(frames chan demodFrame, d *demodState, f demodFrame, output *outputState) bool {
+	if frames == nil {
+		return r.demodulate(d, f, output)
+	}
+	select {
+	case frames <- f:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// demodulate runs the back end of d on f, sending the audio to output
+func (r *Receiver) demodulate(d *demodState, f demodFrame, output *outputState) bool {
+	start := time.Now()
+	d.lowpassed = f.samples
+	d.setBackEnd(f.settings)
+	d.backEnd(f.resetAGC)
+	r.metrics.demodulated(f.freq, f.took+time.Since(start), f.open)
+	// the AGC gauge follows the receiver's main demodulator
+	if output == r.output {
+		r.metrics.setAGCGain(float64(d.agc.gainNum) / float64(d.agc.gainDen))
+	}
+
+	if !f.output {
+		f.pool.put(f.buf)
+		return true
+	}
+	result := output.pool.get(len(d.lowpassed))
+	copy(result, d.lowpassed)
+	f.pool.put(f.buf)
+	select {
+	case output.resultChan <- audioChunk{result, f.onset}:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// backEndRoutine demodulates the frames from the front end until they run
+// out, closing output's resultChan once done
+func (r *Receiver) backEndRoutine(wg *sync.WaitGroup, d *demodState, frames chan demodFrame, output *outputState) {
+	defer wg.Done()
+	defer close(output.resultChan)
+
+	for f := range frames {
+		if !r.demodulate(d, f, output) {
+			return
+		}
+	}
+}
+
+// pipeline starts a back end for d when -pipeline is given, returning the
+// channel to hand frames off on, or nil to demodulate them in place
+func (r *Receiver) pipeline(wg *sync.WaitGroup, d *demodState, output *outputState) chan demodFrame {
+	if !r.pipelined {
+		return nil
+	}
+	back := *d
+	frames := make(chan demodFrame, 1)
+	wg.Add(1)
+	go r.backEndRoutine(wg, &back, frames, output)
+	return frames
+}
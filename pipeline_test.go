@@ -0,0 +1,84 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// TestPipelineFollowsSettings changes the front end's settings once the
+// back end is running, as a reload might, and checks they reach it
+func TestPipelineFollowsSettings(t *testing.T) {
+	r := newReceiver()
+	r.pipelined = true
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	defer r.cancel()
+
+	front := r.demod
+	front.modeDemod = amDemod
+	front.outputScale = 1
+	front.rateOut = 24000
+
+	var wg sync.WaitGroup
+	frames := r.pipeline(&wg, front, r.output)
+
+	frame := func() demodFrame {
+		samples := make([]int16, 64)
+		for i := range samples {
+			samples[i] = int16(1000 * (i%4 - 2))
+		}
+		return demodFrame{buf: samples, pool: newBufferPool(1), samples: samples, settings: front.backEndSettings(), output: true}
+	}
+
+	// am demodulates pairs of I and Q
+	frames <- frame()
+	if got := <-r.output.resultChan; len(got.buf) != 32 {
+		t.Errorf("back end gave %d samples, want 32", len(got.buf))
+	}
+
+	front.rateOut2 = 12000
+	front.outputScale = 4
+	f := frame()
+	f.onset = true
+	frames <- f
+	got := <-r.output.resultChan
+	if len(got.buf) != 16 {
+		t.Errorf("back end gave %d samples, want 16 once resampled", len(got.buf))
+	}
+	if !got.onset {
+		t.Error("the squelch opening wasn't passed on")
+	}
+
+	close(frames)
+	wg.Wait()
+}
+
+func TestBackEndSettingsRoundTrip(t *testing.T) {
+	a := demodState{modeDemod: fmDemod, outputScale: 3, customAtan: 1, agcEnable: true,
+		deemph: true, deemphA: 5, rateOut: 32000, rateOut2: 16000}
+	var b demodState
+	b.setBackEnd(a.backEndSettings())
+	if reflect.ValueOf(b.modeDemod).Pointer() != reflect.ValueOf(fmDemod).Pointer() {
+		t.Error("modeDemod wasn't carried over")
+	}
+	b.modeDemod = nil
+	a.modeDemod = nil
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("setBackEnd gave %+v, want %+v", b, a)
+	}
+}
@@ -0,0 +1,68 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import "sync/atomic"
+
+// bufferPool recycles the sample buffers handed between goroutines, which
+// would otherwise leave the garbage collector megabytes a second to reclaim;
+// a lot for a Pi. Free buffers are kept in a channel so they may be returned
+// from any goroutine. Ownership passes along with a buffer sent on lpChan or
+// resultChan: the receiver puts it back once done, and mustn't touch it after.
+type bufferPool struct {
+	free chan []int16
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{free: make(chan []int16, size)}
+}
+
+// get returns a buffer of n samples, reusing a free one if it's large enough
+func (p *bufferPool) get(n int) []int16 {
+	select {
+	case buf := <-p.free:
+		if cap(buf) >= n {
+			return buf[:n]
+		}
+	default:
+	}
+	return make([]int16, n)
+}
+
+// put returns buf to the pool, leaving it to the garbage collector if the
+// pool is already full
+func (p *bufferPool) put(buf []int16) {
+	if buf == nil {
+		return
+	}
+	select {
+	case p.free <- buf[:cap(buf)]:
+	default:
+	}
+}
+
+// sharedBuffer is a buffer read by several goroutines at once, such as the
+// channelizer's channels, and returned to its pool by the last to release it
+type sharedBuffer struct {
+	refs int32
+	buf  []int16
+	pool *bufferPool
+}
+
+func (s *sharedBuffer) release() {
+	if atomic.AddInt32(&s.refs, -1) == 0 {
+		s.pool.put(s.buf)
+	}
+}
@@ -0,0 +1,136 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import "math"
+
+const (
+	// Kaiser window shape for about 60dB of stopband attenuation
+	resampleBeta = 5.65
+	// taps of the filter per step of the lower rate; with that window,
+	// enough for a transition from 80% to 100% of the lower Nyquist rate
+	resampleTaps = 36
+)
+
+// resampler changes the rate of audio by up/down, through a polyphase FIR
+// low-pass filter: a Kaiser windowed sinc passing 80% of the lower of the
+// two Nyquist rates, and stopping what would alias from above.
+type resampler struct {
+	up, down int
+	taps     int
+	// the filter's coefficients for each phase of the upsampled input
+	phases [][]float64
+	// the last taps-1 input samples, then those being resampled
+	buf []float64
+	// position of the next output in the upsampled buf
+	t int
+}
+
+func newResampler(from, to int) *resampler {
+	g := gcd(from, to)
+	r := &resampler{up: to / g, down: from / g}
+	widest := maxInt(r.up, r.down)
+	r.taps = (resampleTaps*widest + r.up - 1) / r.up
+	r.buf = make([]float64, r.taps-1)
+	r.t = (r.taps - 1) * r.up
+
+	// the prototype filter runs at the upsampled rate, and makes up for
+	// the zeros upsampling puts between samples
+	n := r.taps * r.up
+	cutoff := 0.9 * 0.5 / float64(widest)
+	r.phases = make([][]float64, r.up)
+	for p := range r.phases {
+		r.phases[p] = make([]float64, r.taps)
+	}
+	for i := 0; i < n; i++ {
+		x := float64(i) - float64(n-1)/2
+		h := 2 * cutoff
+		if x != 0 {
+			h = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		k := 2*float64(i)/float64(n-1) - 1
+		w := bessel0(resampleBeta*math.Sqrt(math.Max(0, 1-k*k))) / bessel0(resampleBeta)
+		r.phases[i%r.up][i/r.up] = h * w * float64(r.up)
+	}
+	return r
+}
+
+// resample appends to dst the samples of src at the new rate
+func (r *resampler) resample(dst []int16, src []int16) []int16 {
+	for _, s := range src {
+		r.buf = append(r.buf, float64(s))
+	}
+	for {
+		n := r.t / r.up
+		if n >= len(r.buf) {
+			break
+		}
+		sum := 0.0
+		for k, h := range r.phases[r.t%r.up] {
+			sum += h * r.buf[n-k]
+		}
+		dst = append(dst, clip16(sum))
+		r.t += r.down
+	}
+
+	drop := len(r.buf) - (r.taps - 1)
+	copy(r.buf, r.buf[drop:])
+	r.buf = r.buf[:r.taps-1]
+	r.t -= drop * r.up
+	return dst
+}
+
+// clip16 rounds s to a 16 bit sample
+func clip16(s float64) int16 {
+	s = math.Floor(s + 0.5)
+	if s > math.MaxInt16 {
+		return math.MaxInt16
+	} else if s < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(s)
+}
+
+// bessel0 is the modified Bessel function of the first kind, order 0
+func bessel0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		f := x / (2 * float64(k))
+		term *= f * f
+		sum += term
+	}
+	return sum
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
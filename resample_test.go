@@ -0,0 +1,80 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestResampler(t *testing.T) {
+	tests := []struct {
+		from, to int
+		freq     float64
+		// gain of a tone through the filter, in dB, within 1dB, or at most
+		// this when stopped
+		gain    float64
+		stopped bool
+	}{
+		{24000, 8000, 1000, 0, false},
+		{24000, 8000, 3000, 0, false},
+		// would alias to 3kHz
+		{24000, 8000, 5000, -50, true},
+		{24000, 8000, 11000, -50, true},
+		{48000, 16000, 6000, 0, false},
+		{48000, 16000, 9000, -50, true},
+		{22050, 16000, 5000, 0, false},
+		{22050, 16000, 9000, -50, true},
+		{8000, 48000, 1000, 0, false},
+		{12000, 16000, 5000, 0, false},
+	}
+	for _, tt := range tests {
+		r := newResampler(tt.from, tt.to)
+		const seconds = 1
+		in := make([]int16, seconds*tt.from)
+		for i := range in {
+			in[i] = int16(10000 * math.Sin(2*math.Pi*tt.freq*float64(i)/float64(tt.from)))
+		}
+		var out []int16
+		for i := 0; i < len(in); i += 441 {
+			out = r.resample(out, in[i:minInt(i+441, len(in))])
+		}
+		if want := seconds * tt.to; absInt(len(out)-want) > r.taps {
+			t.Fatalf("%d to %d Hz: %d samples, want about %d", tt.from, tt.to, len(out), want)
+		}
+
+		// skip the filter filling
+		power := 0.0
+		tail := out[len(out)/4:]
+		for _, s := range tail {
+			power += float64(s) * float64(s)
+		}
+		gain := 10 * math.Log10(power/float64(len(tail))/(10000*10000/2))
+		if tt.stopped {
+			if gain > tt.gain {
+				t.Errorf("%d to %d Hz: %gHz passed at %.1fdB, want below %.0fdB", tt.from, tt.to, tt.freq, gain, tt.gain)
+			}
+		} else if math.Abs(gain-tt.gain) > 1 {
+			t.Errorf("%d to %d Hz: %gHz passed at %.1fdB, want %.0fdB", tt.from, tt.to, tt.freq, gain, tt.gain)
+		}
+	}
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
@@ -0,0 +1,242 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	rtpPCMU = "pcmu"
+	rtpPCMA = "pcma"
+	rtpL16  = "l16"
+
+	// G.711 is always sampled at 8kHz
+	g711Rate = 8000
+
+	// audio is held back this long before a talkspurt starts, so buffers
+	// arriving unevenly from demodRoutine can be sent at an even pace
+	rtpPreroll = 200 * time.Millisecond
+	// most audio queued to send, beyond which the oldest is dropped
+	rtpBacklog = time.Second
+)
+
+// rtpState sends the receiver's audio over UDP as RTP, unicast or multicast,
+// for VoIP and radio over IP gateways. Packets are sent every ptime whilst
+// there's audio, and the packet holding the onset of a transmission, where
+// the squelch opened, carries the marker bit, as does the first sent.
+type rtpState struct {
+	addrStr     string
+	codec       string
+	payloadType int
+	ptime       time.Duration
+	ssrcStr     string
+
+	addr   *net.UDPAddr
+	ssrc   uint32
+	rate   int
+	factor int
+}
+
+// configure checks the RTP settings, once the output rate is known
+func (rtp *rtpState) configure(r *Receiver) (err error) {
+	if rtp.addrStr == "" {
+		return
+	}
+	if r.channelizer.enabled || r.search.enabled || r.survey.spec != "" {
+		return fmt.Errorf("RTP sends a single channel, so can't be combined with channelizing, searching or surveys.")
+	}
+
+	rtp.addr, err = net.ResolveUDPAddr("udp", rtp.addrStr)
+	if err != nil {
+		return fmt.Errorf("Invalid RTP address: %s", err)
+	}
+
+	rate := r.output.rate
+	switch rtp.codec {
+	case rtpPCMU, rtpPCMA:
+		if rate%g711Rate != 0 {
+			return fmt.Errorf("Output rate %d Hz can't be reduced to the 8 kHz of %s.", rate, rtp.codec)
+		}
+		rtp.rate = g711Rate
+	case rtpL16:
+		rtp.rate = rate
+	default:
+		return fmt.Errorf("RTP codec must be %s, %s or %s.", rtpPCMU, rtpPCMA, rtpL16)
+	}
+	rtp.factor = rate / rtp.rate
+
+	if rtp.payloadType < 0 {
+		// static types from RFC 3551, and the first dynamic type for L16,
+		// whose static types are only for 44.1 kHz
+		switch rtp.codec {
+		case rtpPCMU:
+			rtp.payloadType = 0
+		case rtpPCMA:
+			rtp.payloadType = 8
+		default:
+			rtp.payloadType = 96
+		}
+	}
+	if rtp.payloadType > 127 {
+		return fmt.Errorf("RTP payload type must be between 0 and 127.")
+	}
+
+	samples := int64(rtp.ptime) * int64(rtp.rate) / int64(time.Second)
+	if samples < 1 || int64(time.Duration(samples)*time.Second/time.Duration(rtp.rate)) != int64(rtp.ptime) {
+		return fmt.Errorf("RTP packet time must be a whole number of samples at %d Hz.", rtp.rate)
+	}
+
+	if rtp.ssrcStr == "" {
+		rtp.ssrc = randomUint32()
+	} else {
+		var ssrc uint64
+		if ssrc, err = strconv.ParseUint(rtp.ssrcStr, 0, 32); err != nil {
+			return fmt.Errorf("Invalid RTP SSRC '%s'", rtp.ssrcStr)
+		}
+		rtp.ssrc = uint32(ssrc)
+	}
+	return
+}
+
+func randomUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// rtpRoutine sends the audio from the output fan-out at an even pace, one
+// packet each ptime, until the receiver stops
+func (r *Receiver) rtpRoutine(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer r.logf("Returning from rtpRoutine\n")
+
+	rtp := r.rtp
+	conn, err := net.DialUDP("udp", nil, rtp.addr)
+	if err != nil {
+		r.logf("Failed to open RTP socket, '%s'\n", err)
+		return
+	}
+	defer conn.Close()
+
+	l := newListener(rtp.factor)
+	if !r.output.addSink(l) {
+		return
+	}
+	defer r.output.removeSink(l)
+
+	r.logf("Sending RTP (%s, payload type %d, SSRC %08x) to %s\n", rtp.codec, rtp.payloadType, rtp.ssrc, rtp.addr)
+
+	ticker := time.NewTicker(rtp.ptime)
+	defer ticker.Stop()
+
+	samples := int(int64(rtp.ptime) * int64(rtp.rate) / int64(time.Second))
+	backlog := int(int64(rtpBacklog) * int64(rtp.rate) / int64(time.Second))
+	packet := make([]byte, 12, 12+2*samples)
+	seq := uint16(randomUint32())
+	timestamp := randomUint32()
+
+	var queued []int16
+	var queuedSince time.Time
+	sending, first := false, true
+	// where in queued the squelch last opened, or -1
+	onset := -1
+	for {
+		select {
+		case c, ok := <-l.audio:
+			if !ok {
+				return
+			}
+			if len(queued) == 0 {
+				queuedSince = time.Now()
+			}
+			if c.onset {
+				onset = len(queued)
+			}
+			queued = append(queued, c.buf...)
+			l.pool.put(c.buf)
+			if over := len(queued) - backlog; over > 0 {
+				queued = append(queued[:0], queued[over:]...)
+				if onset >= 0 {
+					onset = maxInt(0, onset-over)
+				}
+			}
+
+		case now := <-ticker.C:
+			if !sending && len(queued) > 0 && now.Sub(queuedSince) >= rtpPreroll {
+				sending = true
+			}
+			if sending {
+				if len(queued) == 0 {
+					sending = false
+				} else {
+					n := minInt(samples, len(queued))
+					marker := first || onset >= 0 && onset < n
+					packet = rtp.packet(packet, seq, timestamp, marker, queued[:n], samples)
+					if _, err = conn.Write(packet); err != nil {
+						r.logf("RTP send error: %s\n", err)
+					}
+					queued = append(queued[:0], queued[n:]...)
+					if onset -= n; onset < 0 {
+						onset = -1
+					}
+					seq++
+					first = false
+				}
+			}
+			// the timestamp runs on through silences, giving their length
+			timestamp += uint32(samples)
+
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// packet builds an RTP packet of samples into p, padding the payload out to
+// a full packet of size samples with silence
+func (rtp *rtpState) packet(p []byte, seq uint16, timestamp uint32, marker bool, samples []int16, size int) []byte {
+	p = p[:12]
+	p[0] = 0x80 // version 2, no padding, extensions or CSRCs
+	p[1] = byte(rtp.payloadType)
+	if marker {
+		p[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(p[2:], seq)
+	binary.BigEndian.PutUint32(p[4:], timestamp)
+	binary.BigEndian.PutUint32(p[8:], rtp.ssrc)
+
+	for i := 0; i < size; i++ {
+		var s int16
+		if i < len(samples) {
+			s = samples[i]
+		}
+		switch rtp.codec {
+		case rtpPCMU:
+			p = append(p, linearToULaw(s))
+		case rtpPCMA:
+			p = append(p, linearToALaw(s))
+		default:
+			p = append(p, byte(s>>8), byte(s))
+		}
+	}
+	return p
+}
@@ -0,0 +1,134 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRTPPacket(t *testing.T) {
+	tests := []struct {
+		codec     string
+		pt        int
+		marker    bool
+		seq       uint16
+		timestamp uint32
+		samples   []int16
+		size      int
+		want      []byte
+	}{
+		{rtpPCMU, 0, true, 1, 160, []int16{0, 1000, -1000}, 3,
+			[]byte{0x80, 0x80, 0, 1, 0, 0, 0, 160, 0xca, 0xfe, 0xba, 0xbe, 0xff, 0xce, 0x4e}},
+		{rtpPCMA, 8, false, 0xffff, 0xffffffff, []int16{0, 1000}, 4,
+			[]byte{0x80, 8, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xca, 0xfe, 0xba, 0xbe, 0xd5, 0xfa, 0xd5, 0xd5}},
+		{rtpL16, 96, true, 0x1234, 0x56789abc, []int16{0x0102, -2}, 3,
+			[]byte{0x80, 0xe0, 0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xca, 0xfe, 0xba, 0xbe, 1, 2, 0xff, 0xfe, 0, 0}},
+		{rtpL16, 127, false, 0, 0, nil, 1,
+			[]byte{0x80, 0x7f, 0, 0, 0, 0, 0, 0, 0xca, 0xfe, 0xba, 0xbe, 0, 0}},
+	}
+	for _, tt := range tests {
+		rtp := &rtpState{codec: tt.codec, payloadType: tt.pt, ssrc: 0xcafebabe}
+		p := rtp.packet(make([]byte, 12), tt.seq, tt.timestamp, tt.marker, tt.samples, tt.size)
+		if !bytes.Equal(p, tt.want) {
+			t.Errorf("%s packet\n% x, want\n% x", tt.codec, p, tt.want)
+		}
+	}
+}
+
+// TestRTPMarker sends audio without gaps, as -pad leaves it, and checks the
+// marker bit is set on the first packet and where the squelch opened
+func TestRTPMarker(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	r := newReceiver()
+	r.output.rate = g711Rate
+	r.rtp = &rtpState{
+		addrStr:     conn.LocalAddr().String(),
+		codec:       rtpPCMU,
+		payloadType: -1,
+		ptime:       20 * time.Millisecond,
+		ssrcStr:     "0x1234",
+	}
+	if err = r.rtp.configure(r); err != nil {
+		t.Fatal(err)
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go r.rtpRoutine(&wg)
+	defer wg.Wait()
+	defer r.cancel()
+
+	for {
+		r.output.mu.Lock()
+		n := len(r.output.sinks)
+		r.output.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// 200ms of audio, then a transmission starting in the middle of a
+	// packet, 50 samples into the eleventh
+	chunks := []struct {
+		samples int
+		onset   bool
+	}{
+		{1000, false},
+		{650, false},
+		{750, true},
+	}
+	for _, c := range chunks {
+		r.output.fanOut(make([]int16, c.samples), c.onset)
+	}
+
+	const packets = 15
+	buf := make([]byte, 1500)
+	var markers []int
+	var seq uint16
+	var timestamp uint32
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < packets; i++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := buf[:n]
+		if n != 12+160 || binary.BigEndian.Uint32(p[8:]) != 0x1234 || p[1]&0x7f != 0 {
+			t.Fatalf("packet %d: % x", i, p[:12])
+		}
+		if s, ts := binary.BigEndian.Uint16(p[2:]), binary.BigEndian.Uint32(p[4:]); i > 0 && (s != seq+1 || ts != timestamp+160) {
+			t.Errorf("packet %d: sequence %d and timestamp %d follow %d and %d", i, s, ts, seq, timestamp)
+		}
+		seq, timestamp = binary.BigEndian.Uint16(p[2:]), binary.BigEndian.Uint32(p[4:])
+		if p[1]&0x80 != 0 {
+			markers = append(markers, i)
+		}
+	}
+	if len(markers) != 2 || markers[0] != 0 || markers[1] != 10 {
+		t.Errorf("markers on packets %v, want [0 10]", markers)
+	}
+}
@@ -19,12 +19,11 @@ package main
 import (
 	"fmt"
 	"math"
+	"math/cmplx"
 
 	rtl "github.com/jpoirier/gortlsdr"
 )
 
-var deemphAvg int
-
 func round(x float64) float64 {
 	if x > 0.0 {
 		return math.Floor(x + 0.5)
@@ -165,19 +164,30 @@ func rms(samples []int16, step int) int {
 	return int(math.Sqrt(float64((float32(p) - res) / float32(l))))
 }
 
+// lowpassShift is the right shift keeping the sum of downsample samples
+// within an int16, each reaching 128√2 once through a mixer
+func lowpassShift(downsample int) uint {
+	var shift uint
+	for (downsample*mixerPeak)>>shift > math.MaxInt16 {
+		shift++
+	}
+	return shift
+}
+
 // simple square window FIR
 func lowPass(d *demodState) {
 	var i, i2 int
+	shift := lowpassShift(d.downsample)
 	for i < len(d.lowpassed) {
-		d.nowR += d.lowpassed[i]
-		d.nowJ += d.lowpassed[i+1]
+		d.nowR += int32(d.lowpassed[i])
+		d.nowJ += int32(d.lowpassed[i+1])
 		i += 2
 		d.prevIndex++
 		if d.prevIndex < d.downsample {
 			continue
 		}
-		d.lowpassed[i2] = d.nowR   // * d.output_scale;
-		d.lowpassed[i2+1] = d.nowJ // * d.output_scale;
+		d.lowpassed[i2] = int16(d.nowR >> shift)   // * d.output_scale;
+		d.lowpassed[i2+1] = int16(d.nowJ >> shift) // * d.output_scale;
 		d.prevIndex = 0
 		d.nowR = 0
 		d.nowJ = 0
@@ -210,13 +220,13 @@ func deemphFilter(fm *demodState) {
 	var d int
 	// de-emph IIR
 	for i := 0; i < len(fm.lowpassed); i++ {
-		d = int(fm.lowpassed[i]) - deemphAvg
+		d = int(fm.lowpassed[i]) - fm.deemphAvg
 		if d > 0 {
-			deemphAvg += (d + fm.deemphA/2) / fm.deemphA
+			fm.deemphAvg += (d + fm.deemphA/2) / fm.deemphA
 		} else {
-			deemphAvg += (d - fm.deemphA/2) / fm.deemphA
+			fm.deemphAvg += (d - fm.deemphA/2) / fm.deemphA
 		}
-		fm.lowpassed[i] = int16(deemphAvg)
+		fm.lowpassed[i] = int16(fm.deemphAvg)
 	}
 }
 
@@ -227,12 +237,14 @@ func squelchToRms(db int, dongle *dongleState, demod *demodState) int {
 	}
 	linear := math.Pow(10.0, float64(db)/20.0)
 	gain := 50.0
+	dongle.mu.RLock()
 	if dongle.gain != autoGain {
 		gain = float64(dongle.gain) / 10.0
 	}
+	dongle.mu.RUnlock()
 	gain = 50.0 - gain
 	gain = math.Pow(10.0, gain/20.0)
-	downsample := 1024.0 / float64(demod.downsample)
+	downsample := 1024.0 / float64(demod.downsample>>lowpassShift(demod.downsample))
 	linear = linear / gain
 	linear = linear / downsample
 	return int(linear) + 1
@@ -272,3 +284,122 @@ func softwareAgc(d *demodState) {
 		d.lowpassed[i] = int16(output)
 	}
 }
+
+// in-place iterative radix-2 FFT, len(x) must be a power of two
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		half := size / 2
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < half; k++ {
+				a := x[start+k]
+				b := x[start+k+half] * wk
+				x[start+k] = a + b
+				x[start+k+half] = a - b
+				wk *= w
+			}
+		}
+	}
+}
+
+func hannWindow(n int) []float64 {
+	w := make([]float64, n)
+	for i := range w {
+		w[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	return w
+}
+
+// powerSpectrum adds the power in each bin of a len(acc) point FFT of the
+// unsigned 8 bit IQ samples in buf to acc, ordered lowest frequency first.
+// scratch must be the same length as acc.
+func powerSpectrum(buf []byte, window []float64, scratch []complex128, acc []float64) {
+	n := len(acc)
+	for i := 0; i < n; i++ {
+		re := (float64(buf[2*i]) - 127.5) / 127.5
+		im := (float64(buf[2*i+1]) - 127.5) / 127.5
+		scratch[i] = complex(re*window[i], im*window[i])
+	}
+	fft(scratch)
+
+	// swap halves so negative frequencies come first
+	for i := 0; i < n; i++ {
+		p := scratch[(i+n/2)%n]
+		acc[i] += (real(p)*real(p) + imag(p)*imag(p)) / float64(n*n)
+	}
+}
+
+// mixer is a numerically controlled oscillator, shifting interleaved IQ
+// samples by a fixed frequency
+type mixer struct {
+	shift int
+	phase complex128
+	step  complex128
+}
+
+func newMixer(shift, rate int) *mixer {
+	m := &mixer{phase: 1}
+	m.setShift(shift, rate)
+	return m
+}
+
+func (m *mixer) setShift(shift, rate int) {
+	m.shift = shift
+	m.step = cmplx.Exp(complex(0, 2*math.Pi*float64(shift)/float64(rate)))
+}
+
+// mix writes in, shifted by m.shift Hz, to out
+func (m *mixer) mix(in, out []int16) {
+	p := m.phase
+	for i := 0; i+1 < len(in); i += 2 {
+		s := complex(float64(in[i]), float64(in[i+1])) * p
+		out[i] = int16(real(s))
+		out[i+1] = int16(imag(s))
+		p *= m.step
+	}
+	// renormalise, rounding errors would otherwise change the amplitude
+	m.phase = p / complex(cmplx.Abs(p), 0)
+}
+
+// carrierOffset returns the mean frequency, in Hz, of the signal in the
+// lowpassed IQ samples; for FM this is the discriminator's DC offset
+func carrierOffset(d *demodState) float64 {
+	var sum, n int
+	lp := d.lowpassed
+	for i := 2; i < len(lp)-1; i += 2 {
+		sum += polarDiscriminant(int(lp[i]), int(lp[i+1]), int(lp[i-2]), int(lp[i-1]))
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	// discriminator output is scaled so that pi = 1<<14
+	return float64(sum) / float64(n) * float64(d.rateIn) / (1 << 15)
+}
+
+// afc adjusts the input mixer's correction to cancel any carrier offset left
+// after mixing, keeping the signal centred as the dongle drifts
+func afc(d *demodState) {
+	d.afcShift -= afcGain * carrierOffset(d)
+	if limit := float64(d.rateIn) / 2; math.Abs(d.afcShift) > limit {
+		d.afcShift = math.Copysign(limit, d.afcShift)
+	}
+
+	if math.Abs(d.afcShift-d.afcReported) >= afcReportStep {
+		d.afcReported = d.afcShift
+		d.logf("AFC correcting drift of %+.0f Hz\n", -d.afcShift)
+	}
+}
@@ -0,0 +1,180 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// level reports discarded after retuning, besides one per buffer left
+	// queued from the previous channel, as they may predate it
+	searchSettle = 2
+	// level reports considered per channel
+	searchSamples = 3
+)
+
+// searchState records the hits found whilst searching a band
+type searchState struct {
+	enabled    bool
+	settle     int
+	filename   string
+	file       *os.File
+	mu         sync.Mutex
+	discovered map[uint32]*discovery
+	known      map[uint32]bool
+	output     *outputState
+
+	levelChan chan int
+}
+
+type discovery struct {
+	Freq  uint32    `json:"freq"`
+	Level int       `json:"level"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+	Hits  int       `json:"hits"`
+}
+
+// searchRoutine sweeps the channel list in place of controllerRoutine,
+// logging every channel found above the squelch level rather than stopping
+// on it.
+func (r *Receiver) searchRoutine(wg *sync.WaitGroup) {
+	var err error
+
+	defer wg.Done()
+	defer r.logf("Returning from searchRoutine\n")
+
+	s := r.controller
+
+	if err = r.setup(); err != nil {
+		r.logf("%s, stopping\n", err)
+		r.stop()
+		return
+	}
+
+	for {
+		level, ok := r.search.measure()
+		if !ok {
+			return
+		}
+
+		if level >= r.demod.squelchLevel {
+			r.search.hit(s.userFreq(s.freqs[s.freqNow]), level)
+		}
+
+		if err = s.advance(); err != nil {
+			r.logf("Error setting frequency %d: %s\n", r.dongle.freq, err)
+		}
+	}
+}
+
+// measure returns the loudest level demodRoutine reports for the channel,
+// once the tuner has settled
+func (s *searchState) measure() (level int, ok bool) {
+	var l int
+	for i := 0; i < s.settle+searchSamples; i++ {
+		l, ok = <-s.levelChan
+		if !ok {
+			return
+		}
+		if i >= s.settle && l > level {
+			level = l
+		}
+	}
+	return
+}
+
+func (s *searchState) hit(freq uint32, level int) {
+	now := time.Now()
+	fmt.Fprintf(s.output.file, "%s %d %d\n", now.Format(time.RFC3339), freq, level)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.discovered[freq]
+	if ok {
+		d.Last = now
+		d.Hits++
+		if level > d.Level {
+			d.Level = level
+		}
+		return
+	}
+	s.discovered[freq] = &discovery{Freq: freq, Level: level, First: now, Last: now, Hits: 1}
+
+	if s.file == nil || s.known[freq] {
+		return
+	}
+	s.known[freq] = true
+	fmt.Fprintf(os.Stderr, "Discovered channel %d Hz\n", freq)
+
+	_, err := fmt.Fprintln(s.file, formatFreq(freq))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "discovered channels write error: %s\n", err)
+	}
+}
+
+// openDiscovered opens the discovered channels file for appending, noting
+// the channels found by previous searches so they aren't repeated.
+func (s *searchState) openDiscovered() (err error) {
+	s.file, err = os.OpenFile(s.filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	scanner := bufio.NewScanner(s.file)
+	for scanner.Scan() {
+		freq, err := freqHz(strings.TrimSpace(scanner.Text()))
+		if err == nil {
+			s.known[freq] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// formatFreq is the inverse of freqHz, so the discovered channels file can
+// be used to build a scan list.
+func formatFreq(freq uint32) string {
+	return strconv.FormatFloat(float64(freq)/1e6, 'f', -1, 64) + "M"
+}
+
+func handleDiscovered(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	search := rx.search
+
+	search.mu.Lock()
+	channels := make([]discovery, 0, len(search.discovered))
+	for _, d := range search.discovered {
+		channels = append(channels, *d)
+	}
+	search.mu.Unlock()
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Freq < channels[j].Freq
+	})
+	writeJSON(w, channels)
+}
@@ -0,0 +1,69 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import "testing"
+
+func TestFormatFreq(t *testing.T) {
+	tests := []struct {
+		freq uint32
+		want string
+	}{
+		{145500000, "145.5M"},
+		{446006250, "446.00625M"},
+		{446193750, "446.19375M"},
+		{162550000, "162.55M"},
+		{128012500, "128.0125M"},
+		{7074000, "7.074M"},
+		{1, "0.000001M"},
+	}
+	for _, tt := range tests {
+		got := formatFreq(tt.freq)
+		if got != tt.want {
+			t.Errorf("formatFreq(%d) = %q, want %q", tt.freq, got, tt.want)
+		}
+		if back, err := freqHz(got); err != nil || back != tt.freq {
+			t.Errorf("freqHz(formatFreq(%d)) = %d, %v", tt.freq, back, err)
+		}
+	}
+
+	// every channel of a 3.125 kHz raster survives the round trip
+	for freq := uint32(100000000); freq < 500000000; freq += 3125 {
+		if back, _ := freqHz(formatFreq(freq)); back != freq {
+			t.Fatalf("freqHz(formatFreq(%d)) = %d", freq, back)
+		}
+	}
+}
+
+// TestMeasureSkipsQueued checks the levels of the buffers queued before a
+// retune, from the previous channel, are ignored
+func TestMeasureSkipsQueued(t *testing.T) {
+	r := newReceiver()
+	r.queueLen = 4
+	r.search.settle = r.queueLen + searchSettle
+
+	go func() {
+		for i := 0; i < r.search.settle; i++ {
+			r.search.levelChan <- 1000
+		}
+		for _, l := range []int{10, 30, 20} {
+			r.search.levelChan <- l
+		}
+	}()
+	level, ok := r.search.measure()
+	if !ok || level != 30 {
+		t.Errorf("measure() = %d, %t, want 30, true", level, ok)
+	}
+}
@@ -0,0 +1,220 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverState is the HTTP listener used to control the receiver at runtime
+type serverState struct {
+	addr    string
+	tlsCert string
+	tlsKey  string
+	srv     *http.Server
+
+	mu sync.RWMutex
+	// clients must give one of creds, unless it's nil
+	creds []credential
+}
+
+type channelStatus struct {
+	Freq     uint32     `json:"freq"`
+	Priority bool       `json:"priority,omitempty"`
+	Current  bool       `json:"current"`
+	Locked   bool       `json:"locked"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+func (s *serverState) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleIndex)
+	mux.HandleFunc("/spectrum", handleSpectrum)
+	mux.HandleFunc("/spectrum/ws", handleSpectrumWebsocket)
+	mux.HandleFunc("/channels", handleChannels)
+	mux.HandleFunc("/channels/lockout", handleLockout)
+	mux.HandleFunc("/channels/skip", handleLockout)
+	mux.HandleFunc("/channels/unlock", handleUnlock)
+	mux.HandleFunc("/discovered", handleDiscovered)
+	mux.HandleFunc("/device", handleDevice)
+	mux.HandleFunc("/receivers", handleReceivers)
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/audio", handleAudio)
+	mux.HandleFunc("/session", handleSession)
+	return mux
+}
+
+func serverRoutine(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	var err error
+	if server.tlsCert != "" {
+		fmt.Fprintf(os.Stderr, "Listening on %s with TLS\n", server.addr)
+		server.srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		err = server.srv.ListenAndServeTLS(server.tlsCert, server.tlsKey)
+	} else {
+		fmt.Fprintf(os.Stderr, "Listening on %s\n", server.addr)
+		err = server.srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "HTTP server failed, err %s\n", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Returning from serverRoutine\n")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "HTTP response error: %s\n", err)
+	}
+}
+
+// requestFreq parses the freq query parameter, e.g. ?freq=145.5M
+func requestFreq(r *http.Request) (freq uint32, err error) {
+	val := r.URL.Query().Get("freq")
+	if val == "" {
+		err = fmt.Errorf("Missing freq parameter")
+		return
+	}
+	return freqHz(val)
+}
+
+// requestReceiver returns the receiver named by the receiver query parameter,
+// defaulting to the first
+func requestReceiver(w http.ResponseWriter, r *http.Request) *Receiver {
+	name := r.URL.Query().Get("receiver")
+	if name == "" {
+		return receivers[0]
+	}
+	for _, rx := range receivers {
+		if rx.name == name {
+			return rx
+		}
+	}
+	http.Error(w, "No such receiver", http.StatusNotFound)
+	return nil
+}
+
+// handleChannels lists the scan list followed by the priority channels, any
+// of which may be locked out or skipped
+func handleChannels(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	controller := rx.controller
+
+	now := time.Now()
+	current := controller.tunedFreq()
+
+	// the scan list is replaced on reload
+	controller.mu.Lock()
+	freqs, priority := controller.freqs, controller.priority
+	controller.mu.Unlock()
+
+	var channels []channelStatus
+	listed := make(map[uint32]int)
+	add := func(freq uint32, isPriority bool) {
+		if i, ok := listed[freq]; ok {
+			channels[i].Priority = channels[i].Priority || isPriority
+			return
+		}
+		status := channelStatus{
+			Freq:     controller.userFreq(freq),
+			Priority: isPriority,
+			Current:  freq == current,
+		}
+		if until, ok := controller.lockedOut(freq, now); ok {
+			status.Locked = true
+			if !until.IsZero() {
+				status.Until = &until
+			}
+		}
+		listed[freq] = len(channels)
+		channels = append(channels, status)
+	}
+	for _, freq := range freqs {
+		add(freq, false)
+	}
+	for _, freq := range priority {
+		add(freq, true)
+	}
+	writeJSON(w, channels)
+}
+
+// handleLockout serves both /channels/lockout, which is permanent, and
+// /channels/skip?for=10m, which expires.
+func handleLockout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	controller := rx.controller
+
+	freq, err := requestFreq(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var d time.Duration
+	if r.URL.Path == "/channels/skip" {
+		d, err = time.ParseDuration(r.URL.Query().Get("for"))
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid skip duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err = controller.lockout(controller.channelFreq(freq), d); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleUnlock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+
+	freq, err := requestFreq(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rx.controller.unlock(rx.controller.channelFreq(freq))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,54 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestChannelsListPriority(t *testing.T) {
+	r := newReceiver()
+	r.controller.freqs = frequencies{145500000, 145525000}
+	r.controller.priority = frequencies{145800000, 145525000}
+
+	saved := receivers
+	receivers = []*Receiver{r}
+	defer func() { receivers = saved }()
+
+	w := httptest.NewRecorder()
+	handleLockout(w, httptest.NewRequest(http.MethodPost, "/channels/lockout?freq=145.8M", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("lockout of a priority channel: status %d, %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleChannels(w, httptest.NewRequest(http.MethodGet, "/channels", nil))
+	var got []channelStatus
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := []channelStatus{
+		{Freq: 145500000},
+		{Freq: 145525000, Priority: true},
+		{Freq: 145800000, Priority: true, Locked: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("/channels = %+v, want %+v", got, want)
+	}
+}
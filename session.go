@@ -0,0 +1,440 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// sessionsState serves clients of /session, each with a virtual receiver of
+// its own: a channel mixed down from the dongle's capture, demodulated with
+// its own mode and squelch, as WebSDR does. Every session mixes the whole
+// capture, so their number is limited by -sessions.
+type sessionsState struct {
+	max int
+
+	mu       sync.Mutex
+	list     map[*session]bool
+	finished bool
+	pool     *bufferPool
+	// the receiver's demodulator as configured by its flags, for each
+	// session to start from
+	demod demodState
+}
+
+// sessionCapture is a buffer of the capture, as the dongle was tuned for it
+type sessionCapture struct {
+	shared *sharedBuffer
+	tuning dongleTuning
+}
+
+// sessionTune is what a client asks to receive; when tuning, omitted fields
+// are left as they were
+type sessionTune struct {
+	Freq    string `json:"freq,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+	Squelch *int   `json:"squelch,omitempty"`
+}
+
+type sessionStatus struct {
+	Freq    uint32 `json:"freq"`
+	Mode    string `json:"mode"`
+	Squelch int    `json:"squelch"`
+	Codec   string `json:"codec"`
+	Rate    int    `json:"rate"`
+	Low     uint32 `json:"low"`
+	High    uint32 `json:"high"`
+	Error   string `json:"error,omitempty"`
+}
+
+// sessionSettings are what a session is tuned to
+type sessionSettings struct {
+	freq    uint32
+	mode    string
+	squelch int
+}
+
+type session struct {
+	iqChan   chan sessionCapture
+	tuneChan chan sessionSettings
+	audio    *listener
+}
+
+// tap passes a copy of buf, captured with tuning, to each session; it's
+// called from rtlsdrCallback so mustn't block.
+func (s *sessionsState) tap(buf []int16, tuning dongleTuning) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.list) == 0 {
+		return
+	}
+
+	c := s.pool.get(len(buf))
+	copy(c, buf)
+	shared := &sharedBuffer{refs: int32(len(s.list)), buf: c, pool: s.pool}
+	for sess := range s.list {
+		select {
+		case sess.iqChan <- sessionCapture{shared, tuning}:
+		default:
+			shared.release()
+		}
+	}
+}
+
+func (s *sessionsState) add(sess *session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return fmt.Errorf("Receiver has stopped")
+	}
+	if len(s.list) >= s.max {
+		return fmt.Errorf("All %d sessions are in use", s.max)
+	}
+	if s.list == nil {
+		s.list = make(map[*session]bool)
+	}
+	s.list[sess] = true
+	return nil
+}
+
+func (s *sessionsState) remove(sess *session) {
+	s.mu.Lock()
+	if s.list[sess] {
+		delete(s.list, sess)
+		close(sess.iqChan)
+	}
+	s.mu.Unlock()
+}
+
+// closeAll ends every session once the capture has stopped
+func (s *sessionsState) closeAll() {
+	s.mu.Lock()
+	s.finished = true
+	for sess := range s.list {
+		delete(s.list, sess)
+		close(sess.iqChan)
+	}
+	s.mu.Unlock()
+}
+
+// tuneSession checks t, applying it over the session's current settings
+func (r *Receiver) tuneSession(sess sessionSettings, t sessionTune) (sessionSettings, error) {
+	if t.Freq != "" {
+		freq, err := freqHz(t.Freq)
+		if err != nil {
+			return sess, err
+		}
+		tuning := r.dongle.tuning()
+		low, high := tuning.window(r.demod.rateIn)
+		if freq < low || freq > high {
+			return sess, fmt.Errorf("%d Hz is outside the dongle's window of %d to %d Hz", freq, low, high)
+		}
+		if !tuning.reaches(freq, r.demod.rateIn) {
+			return sess, fmt.Errorf("%d Hz is on the dongle's DC spike at %d Hz", freq, tuning.freq)
+		}
+		sess.freq = freq
+	}
+	if t.Mode != "" {
+		if t.Mode != "fm" && t.Mode != "am" {
+			return sess, fmt.Errorf("Sessions may only use fm or am")
+		}
+		sess.mode = t.Mode
+	}
+	if t.Squelch != nil {
+		sess.squelch = *t.Squelch
+	}
+	return sess, nil
+}
+
+// configured is a demodulator set up from d's flags alone: none of the
+// state of one running, such as its mixer and buffers, nor what setup
+// works out for the dongle's tuning, which sessionDemod does for a session
+func (d *demodState) configured() demodState {
+	return demodState{
+		rateIn:         d.rateIn,
+		rateOut:        d.rateOut,
+		rateOut2:       d.rateOut2,
+		postDownsample: d.postDownsample,
+		conseqSquelch:  d.conseqSquelch,
+		squelchHits:    d.conseqSquelch + 1,
+		customAtan:     d.customAtan,
+		deemph:         d.deemph,
+		deemphA:        d.deemphA,
+		agcEnable:      d.agcEnable,
+		agc: agcState{
+			gainNum:    d.agc.gainDen,
+			gainDen:    d.agc.gainDen,
+			gainMax:    d.agc.gainMax,
+			peakTarget: d.agc.peakTarget,
+			attackStep: d.agc.attackStep,
+			decayStep:  d.agc.decayStep,
+		},
+		afcEnable: d.afcEnable,
+		logf:      d.logf,
+	}
+}
+
+// sessionDemod sets up a demodulator for the session, configured as the
+// receiver's own
+func (r *Receiver) sessionDemod(sess sessionSettings, rate uint32) *demodState {
+	d := r.sessions.demod
+	d.downsample = int(rate) / d.rateIn
+	d.modeDemod = amDemod
+	d.outputScale = (1 << 15) / (128 * d.downsample)
+	if d.outputScale < 1 {
+		d.outputScale = 1
+	}
+	if sess.mode == "fm" {
+		d.modeDemod = fmDemod
+		d.outputScale = 1
+	}
+	d.squelchLevel = squelchToRms(sess.squelch, r.dongle, &d)
+	return &d
+}
+
+// sessionRoutine mixes the session's channel down from the capture and
+// demodulates it, until the session is removed
+func (r *Receiver) sessionRoutine(sess *session, tuned sessionSettings) {
+	defer sess.audio.close()
+
+	var d *demodState
+	var m *mixer
+	var tuning dongleTuning
+	squelched := true
+	pool := newBufferPool(2)
+
+	for c := range sess.iqChan {
+		select {
+		case tuned = <-sess.tuneChan:
+			d = nil
+		default:
+		}
+		if d == nil || c.tuning != tuning {
+			if d == nil || c.tuning.rate != tuning.rate {
+				d = r.sessionDemod(tuned, c.tuning.rate)
+			}
+			tuning = c.tuning
+			// the capture is rotated to be centred on tuning.center()
+			m = newMixer(int(tuning.center())-int(tuned.freq), int(tuning.rate))
+		}
+
+		// the dongle has moved off the session's channel
+		if !tuning.reaches(tuned.freq, d.rateIn) {
+			c.shared.release()
+			continue
+		}
+
+		buf := pool.get(len(c.shared.buf))
+		m.mix(c.shared.buf, buf)
+		c.shared.release()
+
+		d.lowpassed = buf
+		d.fullDemod()
+		if d.squelchLevel > 0 && d.squelchHits > d.conseqSquelch {
+			d.squelchHits = d.conseqSquelch + 1
+			squelched = true
+		} else {
+			sess.audio.write(d.lowpassed, squelched)
+			squelched = false
+		}
+		pool.put(buf)
+	}
+}
+
+// handleSession serves a session over a WebSocket. The session starts tuned
+// by the query, e.g. ?freq=145.5M&mode=fm&squelch=20&codec=adpcm&bitrate=32k,
+// and is retuned by text messages such as {"freq":"145.6M","squelch":10}.
+// Each is answered with the session's status as JSON, giving any error; the
+// audio follows in binary messages, each holding whole ADPCM blocks, PCM, or
+// one Opus packet.
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	if rx.sessions.max == 0 || rx.survey.spec != "" {
+		http.Error(w, "sessions not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	t := sessionTune{Freq: query.Get("freq"), Mode: query.Get("mode")}
+	if t.Mode == "" {
+		t.Mode = "fm"
+	}
+	if val := query.Get("squelch"); val != "" {
+		squelch, err := strconv.Atoi(val)
+		if err != nil {
+			http.Error(w, "Invalid squelch", http.StatusBadRequest)
+			return
+		}
+		t.Squelch = &squelch
+	}
+	if t.Freq == "" {
+		http.Error(w, "Missing freq parameter", http.StatusBadRequest)
+		return
+	}
+	tuned, err := rx.tuneSession(sessionSettings{}, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	codec := query.Get("codec")
+	if codec == "" {
+		codec = codecADPCM
+	}
+	bitrate := defaultBitrate(codec, rx.output.rate)
+	if val := query.Get("bitrate"); val != "" {
+		b, err := freqHz(val)
+		if err != nil {
+			http.Error(w, "Invalid bitrate", http.StatusBadRequest)
+			return
+		}
+		bitrate = int(b)
+	}
+	factor, err := rateFactor(rx.output.rate, codec, bitrate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Opus is sent a packet to a message, rather than in Ogg
+	rate := rx.output.rate / factor
+	var enc encoder
+	var opus *opusEncoder
+	if codec == codecOpus {
+		opus, err = newOpusEncoder(rate, bitrate)
+		rate = opusRate
+	} else {
+		enc, err = newEncoder(codec, rate, bitrate, rx.logf)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sess := &session{
+		iqChan:   make(chan sessionCapture, 2),
+		tuneChan: make(chan sessionSettings, 1),
+		audio:    newListener(factor),
+	}
+	if err = rx.sessions.add(sess); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer rx.sessions.remove(sess)
+	go rx.sessionRoutine(sess, tuned)
+
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// sessionRoutine keeps its own copy of the settings
+	current := tuned
+	status := func(err error) error {
+		low, high := rx.dongle.tuning().window(rx.demod.rateIn)
+		s := sessionStatus{
+			Freq:    current.freq,
+			Mode:    current.mode,
+			Squelch: current.squelch,
+			Codec:   codec,
+			Rate:    rate,
+			Low:     low,
+			High:    high,
+		}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		msg, _ := json.Marshal(s)
+		return conn.writeMessage(wsText, msg)
+	}
+	if err = status(nil); err != nil {
+		return
+	}
+
+	tunes := make(chan sessionTune)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			opcode, payload, err := conn.readMessage()
+			if err != nil {
+				return
+			}
+			if opcode != wsText {
+				continue
+			}
+			var t sessionTune
+			if err = json.Unmarshal(payload, &t); err != nil {
+				t = sessionTune{Freq: "invalid"}
+			}
+			select {
+			case tunes <- t:
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var b []byte
+	var sendErr error
+	sendPacket := func(p []byte) {
+		if sendErr == nil {
+			sendErr = conn.writeMessage(wsBinary, p)
+		}
+	}
+	for {
+		select {
+		case t := <-tunes:
+			next, err := rx.tuneSession(current, t)
+			if err == nil {
+				current = next
+				// replace any retune sessionRoutine is yet to apply
+				select {
+				case <-sess.tuneChan:
+				default:
+				}
+				sess.tuneChan <- next
+			}
+			if err = status(err); err != nil {
+				return
+			}
+		case c, ok := <-sess.audio.audio:
+			if !ok {
+				conn.writeMessage(wsClose, nil)
+				return
+			}
+			if opus != nil {
+				if err := opus.packets(c.buf, sendPacket); err != nil {
+					rx.logf("Dropped Opus audio for a session, '%s'\n", err)
+				}
+			} else if b = enc.encode(b[:0], c.buf); len(b) > 0 {
+				sendPacket(b)
+			}
+			sess.audio.pool.put(c.buf)
+			if sendErr != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
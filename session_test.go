@@ -0,0 +1,112 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+)
+
+// TestSessionDemod checks a session's demodulator follows the receiver's
+// flags and its own settings, whatever the receiver's setup has done since
+func TestSessionDemod(t *testing.T) {
+	tests := []struct {
+		args    []string
+		sess    sessionSettings
+		rate    uint32
+		mode    func(*demodState)
+		scale   int
+		squelch bool
+	}{
+		{[]string{"-f", "145.5M", "-M", "fm", "-l", "20"}, sessionSettings{145600000, "fm", 0}, 1024000, fmDemod, 1, false},
+		{[]string{"-f", "145.5M", "-M", "fm"}, sessionSettings{145600000, "am", 10}, 1024000, amDemod, 6, true},
+		{[]string{"-f", "118.1M", "-s", "12k"}, sessionSettings{118200000, "am", 0}, 1200000, amDemod, 2, false},
+	}
+	for _, tt := range tests {
+		r := newReceiver()
+		fs := flag.NewFlagSet("sdrctl", flag.ContinueOnError)
+		r.flags(fs)
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.configure(nil); err != nil {
+			t.Fatal(err)
+		}
+		r.sessions.demod = r.demod.configured()
+
+		// as setup and a running demodulator leave the receiver's
+		optimalSettings(int(r.controller.freqs[0]), r.dongle, r.demod)
+		r.demod.squelchLevel = squelchToRms(r.demod.squelchLevel, r.dongle, r.demod)
+		r.demod.mix = newMixer(1000, r.demod.rateIn*r.demod.downsample)
+		r.demod.lowpassed = make([]int16, 16)
+		r.demod.squelchHits = 0
+
+		d := r.sessionDemod(tt.sess, tt.rate)
+		if d.mix != nil || d.lowpassed != nil {
+			t.Errorf("%v: session shares the receiver's mixer or buffer", tt.args)
+		}
+		if want := int(tt.rate) / r.demod.rateIn; d.downsample != want {
+			t.Errorf("%v: downsample %d, want %d", tt.args, d.downsample, want)
+		}
+		if reflect.ValueOf(d.modeDemod).Pointer() != reflect.ValueOf(tt.mode).Pointer() || d.outputScale != tt.scale {
+			t.Errorf("%v: session %s has output scale %d, want %d", tt.args, tt.sess.mode, d.outputScale, tt.scale)
+		}
+		if (d.squelchLevel > 0) != tt.squelch || d.squelchHits <= d.conseqSquelch {
+			t.Errorf("%v: squelch level %d, hits %d", tt.args, d.squelchLevel, d.squelchHits)
+		}
+		if d.logf == nil {
+			t.Errorf("%v: session has no log for its AFC", tt.args)
+		}
+		if d.rateIn != r.demod.rateIn || d.rateOut != r.demod.rateOut || d.agc.gainNum != d.agc.gainDen {
+			t.Errorf("%v: rates %d/%d and AGC %+v not as configured", tt.args, d.rateIn, d.rateOut, d.agc)
+		}
+	}
+}
+
+// TestTuneSession checks sessions may only tune within the dongle's capture,
+// which preRotate puts mostly above the centre of the rotated buffers
+func TestTuneSession(t *testing.T) {
+	r := newReceiver()
+	r.demod.rateIn = 24000
+	// at 1008000 S/s, tuned to 145.252MHz and usable from 144.8608 to
+	// 145.6432MHz
+	optimalSettings(145000000, r.dongle, r.demod)
+
+	tests := []struct {
+		freq string
+		want bool
+	}{
+		{"145M", true},
+		{"144.8608M", true},
+		{"144860.799K", false},
+		{"144.7M", false},
+		{"144.65M", false},
+		{"145.6432M", true},
+		{"145643.201K", false},
+		{"145.5M", true},
+		// the DC spike
+		{"145.252M", false},
+		{"145.24M", false},
+		{"145.228M", true},
+		{"145.276M", true},
+	}
+	for _, tt := range tests {
+		_, err := r.tuneSession(sessionSettings{}, sessionTune{Freq: tt.freq})
+		if (err == nil) != tt.want {
+			t.Errorf("tuneSession(%s) error = %v, want accepted %t", tt.freq, err, tt.want)
+		}
+	}
+}
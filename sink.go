@@ -0,0 +1,273 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// the lowest sample rate a listener may ask for, by way of its bitrate
+	minimumListenRate = 4000
+	// pause in the audio after which a stream is sent what the encoder
+	// holds back
+	syncDelay = 250 * time.Millisecond
+)
+
+// audioChunk is a buffer of a receiver's audio on its way out; onset marks
+// the first after the squelch opens, where a transmission starts
+type audioChunk struct {
+	buf   []int16
+	onset bool
+}
+
+// sink is a destination for a receiver's audio besides its output file,
+// fed by outputRoutine. The buffer given to write is recycled once it
+// returns, so must be copied if kept, and write mustn't block.
+type sink interface {
+	write(buf []int16, onset bool)
+	close()
+}
+
+// addSink starts fanning the output out to s; false once the output has
+// finished
+func (o *outputState) addSink(s sink) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.finished {
+		return false
+	}
+	if o.sinks == nil {
+		o.sinks = make(map[sink]bool)
+	}
+	o.sinks[s] = true
+	return true
+}
+
+func (o *outputState) removeSink(s sink) {
+	o.mu.Lock()
+	if o.sinks[s] {
+		delete(o.sinks, s)
+		s.close()
+	}
+	o.mu.Unlock()
+}
+
+func (o *outputState) fanOut(buf []int16, onset bool) {
+	o.mu.Lock()
+	for s := range o.sinks {
+		s.write(buf, onset)
+	}
+	o.mu.Unlock()
+}
+
+// closeSinks closes every sink once the audio has run out
+func (o *outputState) closeSinks() {
+	o.mu.Lock()
+	o.finished = true
+	for s := range o.sinks {
+		delete(o.sinks, s)
+		s.close()
+	}
+	o.mu.Unlock()
+}
+
+// listener passes a receiver's audio to an HTTP client, decimating it by
+// factor to meet the bitrate it asked for; audio is dropped should it not
+// keep up, though not the onset of a transmission, which is carried over
+type listener struct {
+	factor    int
+	decimator *resampler
+	pool      *bufferPool
+	audio     chan audioChunk
+	onset     bool
+}
+
+func newListener(factor int) *listener {
+	l := &listener{
+		factor: factor,
+		pool:   newBufferPool(6),
+		audio:  make(chan audioChunk, 4),
+	}
+	if factor > 1 {
+		l.decimator = newResampler(factor, 1)
+	}
+	return l
+}
+
+func (l *listener) write(buf []int16, onset bool) {
+	out := l.pool.get(len(buf)/l.factor + 1)[:0]
+	if l.decimator != nil {
+		out = l.decimator.resample(out, buf)
+	} else {
+		out = append(out, buf...)
+	}
+	l.onset = l.onset || onset
+	select {
+	case l.audio <- audioChunk{out, l.onset}:
+		l.onset = false
+	default:
+		l.pool.put(out)
+	}
+}
+
+func (l *listener) close() {
+	close(l.audio)
+}
+
+// rateFactor is the least factor by which rate must be divided to send
+// codec within bitrate
+func rateFactor(rate int, codec string, bitrate int) (factor int, err error) {
+	if codec == codecOpus {
+		// Opus meets the bitrate itself
+		return 1, nil
+	}
+	bits := bitsPerSample(codec)
+	for factor = 1; rate/factor >= minimumListenRate; factor++ {
+		if rate%factor == 0 && rate/factor*bits <= bitrate {
+			return
+		}
+	}
+	return 0, fmt.Errorf("Bitrate too low for %s, which needs at least %d bits/s", codec, minimumListenRate*bits)
+}
+
+// handleAudio streams a receiver's audio as a WAV file of unknown length, or
+// Ogg Opus. ?codec= chooses pcm, adpcm (the default) or opus, and ?bitrate=
+// the most bits/s to send, met by Opus itself or else by lowering the sample
+// rate. When channelizing, ?freq= picks the channel.
+func handleAudio(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	if rx.search.enabled || rx.survey.spec != "" {
+		http.Error(w, "no audio available", http.StatusServiceUnavailable)
+		return
+	}
+
+	output := rx.output
+	if rx.channelizer.enabled {
+		freq, err := requestFreq(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		output = nil
+		for _, ch := range rx.channelizer.channels {
+			if rx.controller.userFreq(ch.freq) == freq {
+				output = ch.output
+			}
+		}
+		if output == nil {
+			http.Error(w, "No such channel", http.StatusNotFound)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	codec := query.Get("codec")
+	if codec == "" {
+		codec = codecADPCM
+	}
+	bitrate := defaultBitrate(codec, output.rate)
+	if val := query.Get("bitrate"); val != "" {
+		// bitrates are given like frequencies, e.g. 16k
+		b, err := freqHz(val)
+		if err != nil {
+			http.Error(w, "Invalid bitrate", http.StatusBadRequest)
+			return
+		}
+		bitrate = int(b)
+	}
+	factor, err := rateFactor(output.rate, codec, bitrate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rate := output.rate / factor
+	enc, err := newEncoder(codec, rate, bitrate, rx.logf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	l := newListener(factor)
+	if !output.addSink(l) {
+		http.Error(w, "no audio available", http.StatusServiceUnavailable)
+		return
+	}
+	defer output.removeSink(l)
+
+	var b []byte
+	if codec == codecOpus {
+		w.Header().Set("Content-Type", "audio/ogg")
+		// the stream's headers, sent ahead of any audio
+		b = enc.sync(b)
+	} else {
+		w.Header().Set("Content-Type", "audio/wav")
+		b = wavHeader(codec, rate, wavStreaming, wavStreaming)
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Sample-Rate", strconv.Itoa(rate))
+	if _, err = w.Write(b); err != nil {
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	send := func(b []byte) error {
+		if len(b) == 0 {
+			return nil
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// should the audio pause, send on what the encoder's holding
+	pause := time.NewTimer(syncDelay)
+	defer pause.Stop()
+	for {
+		select {
+		case c, ok := <-l.audio:
+			if !ok {
+				return
+			}
+			b = enc.encode(b[:0], c.buf)
+			l.pool.put(c.buf)
+			if err = send(b); err != nil {
+				return
+			}
+			if !pause.Stop() {
+				select {
+				case <-pause.C:
+				default:
+				}
+			}
+			pause.Reset(syncDelay)
+		case <-pause.C:
+			if err = send(enc.sync(b[:0])); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
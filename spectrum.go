@@ -0,0 +1,230 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//go:embed web/index.html
+var indexPage []byte
+
+// spectrumState periodically transforms the raw IQ from the dongle, serving
+// the resulting power-per-bin frames over HTTP
+type spectrumState struct {
+	enabled  bool
+	size     int
+	interval time.Duration
+	last     time.Time
+
+	iqChan  chan spectrumCapture
+	mu      sync.Mutex
+	latest  []byte
+	clients map[chan []byte]bool
+}
+
+type spectrumCapture struct {
+	iq     []byte
+	center uint32
+	rate   uint32
+}
+
+type spectrumFrame struct {
+	Time   time.Time `json:"time"`
+	Center uint32    `json:"center"`
+	Rate   uint32    `json:"rate"`
+	Bins   []float64 `json:"bins"`
+}
+
+// tap copies buf, captured at center and rate, for spectrumRoutine once per
+// interval; it's called from rtlsdrCallback so mustn't block.
+func (s *spectrumState) tap(buf []byte, center, rate uint32) {
+	now := time.Now()
+	if now.Sub(s.last) < s.interval {
+		return
+	}
+	s.last = now
+
+	n := len(buf) / (2 * s.size) * (2 * s.size)
+	if n == 0 {
+		return
+	}
+	iq := make([]byte, n)
+	copy(iq, buf)
+
+	select {
+	case s.iqChan <- spectrumCapture{iq: iq, center: center, rate: rate}:
+	default:
+	}
+}
+
+func (r *Receiver) spectrumRoutine(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	s := r.spectrum
+	window := hannWindow(s.size)
+	scratch := make([]complex128, s.size)
+	acc := make([]float64, s.size)
+
+	for c := range s.iqChan {
+		for i := range acc {
+			acc[i] = 0
+		}
+		ffts := len(c.iq) / (2 * s.size)
+		for i := 0; i < ffts; i++ {
+			powerSpectrum(c.iq[2*s.size*i:2*s.size*(i+1)], window, scratch, acc)
+		}
+
+		frame := spectrumFrame{
+			Time:   time.Now(),
+			Center: c.center,
+			Rate:   c.rate,
+			Bins:   make([]float64, s.size),
+		}
+		for i, p := range acc {
+			frame.Bins[i] = math.Round(100*math.Log10(p/float64(ffts)+1e-20)) / 10
+		}
+
+		data, err := json.Marshal(frame)
+		if err != nil {
+			r.logf("spectrum encoding error: %s\n", err)
+			continue
+		}
+		s.publish(data)
+	}
+
+	s.mu.Lock()
+	for client := range s.clients {
+		close(client)
+		delete(s.clients, client)
+	}
+	s.mu.Unlock()
+
+	r.logf("Returning from spectrumRoutine\n")
+}
+
+// publish stores the frame and passes it on to each subscriber, dropping it
+// for any who haven't kept up
+func (s *spectrumState) publish(frame []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest = frame
+	for client := range s.clients {
+		select {
+		case client <- frame:
+		default:
+		}
+	}
+}
+
+func (s *spectrumState) subscribe() chan []byte {
+	client := make(chan []byte, 4)
+	s.mu.Lock()
+	s.clients[client] = true
+	s.mu.Unlock()
+	return client
+}
+
+func (s *spectrumState) unsubscribe(client chan []byte) {
+	s.mu.Lock()
+	if s.clients[client] {
+		delete(s.clients, client)
+		close(client)
+	}
+	s.mu.Unlock()
+}
+
+func handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(indexPage)
+}
+
+func handleSpectrum(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	spectrum := rx.spectrum
+
+	spectrum.mu.Lock()
+	frame := spectrum.latest
+	spectrum.mu.Unlock()
+
+	if frame == nil {
+		http.Error(w, "no spectrum available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(frame)
+}
+
+func handleSpectrumWebsocket(w http.ResponseWriter, r *http.Request) {
+	rx := requestReceiver(w, r)
+	if rx == nil {
+		return
+	}
+	spectrum := rx.spectrum
+
+	if !spectrum.enabled {
+		http.Error(w, "no spectrum available", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	client := spectrum.subscribe()
+	defer spectrum.unsubscribe(client)
+
+	// frames from the browser are of no interest, but reading them notices
+	// when it goes away
+	gone := make(chan struct{})
+	go func() {
+		for {
+			if _, _, err := conn.readMessage(); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case frame, ok := <-client:
+			if !ok {
+				conn.writeMessage(wsClose, nil)
+				return
+			}
+			if err = conn.writeMessage(wsText, frame); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
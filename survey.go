@@ -0,0 +1,215 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	surveyRate = 2048000
+	// fraction of each hop discarded at the band edges, where the dongle's
+	// filters roll off
+	surveyCrop = 0.2
+	// bounds on the FFTs averaged per hop, per interval
+	surveyMinBins = 256
+	surveyMaxFFTs = 64
+)
+
+// surveyState describes a wideband power survey, written as CSV rows
+// compatible with rtl_power
+type surveyState struct {
+	spec     string
+	start    uint32
+	stop     uint32
+	binSize  uint32
+	interval time.Duration
+}
+
+// parse reads a survey range such as 88M:108M:10k, giving the band limits
+// and desired bin width
+func (s *surveyState) parse() (err error) {
+	bits := strings.Split(s.spec, ":")
+	if len(bits) != 3 {
+		return fmt.Errorf("Survey range could not be parsed, expected start:stop:bin")
+	}
+	if s.start, err = freqHz(bits[0]); err != nil {
+		return
+	}
+	if s.stop, err = freqHz(bits[1]); err != nil {
+		return
+	}
+	if s.binSize, err = freqHz(bits[2]); err != nil {
+		return
+	}
+	if s.stop <= s.start || s.binSize == 0 {
+		return fmt.Errorf("Survey range is empty")
+	}
+	if s.interval <= 0 {
+		return fmt.Errorf("Survey interval must be positive")
+	}
+	return
+}
+
+// surveyPlan lays out the hops and FFT bins covering a survey
+type surveyPlan struct {
+	n        int // FFT size
+	usable   int // bins kept from each hop, the first of which is first
+	first    int
+	hops     int
+	ffts     int // FFTs averaged per hop
+	binWidth float64
+	hopWidth float64
+}
+
+func (s *surveyState) plan() (p surveyPlan) {
+	p.n = surveyMinBins
+	for p.n < surveyRate/int(s.binSize) {
+		p.n <<= 1
+	}
+	p.binWidth = float64(surveyRate) / float64(p.n)
+	p.usable = int(float64(p.n) * (1 - surveyCrop))
+	p.first = (p.n - p.usable) / 2
+	p.hopWidth = float64(p.usable) * p.binWidth
+	p.hops = int(math.Ceil(float64(s.stop-s.start) / p.hopWidth))
+
+	p.ffts = int(s.interval.Seconds() * surveyRate / float64(p.hops*p.n))
+	if p.ffts < 1 {
+		p.ffts = 1
+	}
+	if p.ffts > surveyMaxFFTs {
+		p.ffts = surveyMaxFFTs
+	}
+	return
+}
+
+// row writes one hop's power, summed over p.ffts FFTs in acc, as an rtl_power
+// CSV row starting at low Hz
+func (p *surveyPlan) row(w io.Writer, now time.Time, low float64, acc []float64) {
+	// the centre bin holds the dongle's DC offset
+	acc[p.n/2] = (acc[p.n/2-1] + acc[p.n/2+1]) / 2
+
+	fmt.Fprintf(w, "%s, %.0f, %.0f, %.2f, %d", now.Format("2006-01-02, 15:04:05"),
+		low, low+p.hopWidth, p.binWidth, p.n*p.ffts)
+	for _, pow := range acc[p.first : p.first+p.usable] {
+		fmt.Fprintf(w, ", %.2f", 10*math.Log10(pow/float64(p.ffts)))
+	}
+	fmt.Fprintln(w)
+}
+
+// surveyRoutine sweeps the dongle across the survey range in full bandwidth
+// hops, in place of the demodulation pipeline, writing the averaged power of
+// each hop once per interval.
+func (r *Receiver) surveyRoutine(wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer r.logf("Returning from surveyRoutine\n")
+
+	s, dongle := r.survey, r.dongle
+	p := s.plan()
+	n, ffts := p.n, p.ffts
+
+	r.logf("Survey: %d hops of %.0f Hz, %d bins of %.2f Hz, %d FFTs per hop\n",
+		p.hops, p.hopWidth, p.usable, p.binWidth, ffts)
+
+	err := dongle.dev.SetSampleRate(surveyRate)
+	if err != nil {
+		r.logf("Error setting sample rate %d\n", surveyRate)
+		return
+	}
+	dongle.setTuning(dongle.freq, surveyRate)
+
+	window := hannWindow(n)
+	scratch := make([]complex128, n)
+	acc := make([]float64, n)
+	dump := make([]byte, bufferDump)
+	buf := make([]byte, 2*n*ffts)
+	w := bufio.NewWriter(r.output.file)
+	defer w.Flush()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now()
+		for h := 0; h < p.hops; h++ {
+			select {
+			case <-r.ctx.Done():
+				return
+			default:
+			}
+
+			low := float64(s.start) + float64(h)*p.hopWidth
+			dongle.setTuning(uint32(low+p.hopWidth/2), surveyRate)
+			err = dongle.dev.SetCenterFreq(int(dongle.freq))
+			if err != nil {
+				r.logf("Error setting frequency %d\n", dongle.freq)
+			} else if _, err = dongle.dev.ReadSync(dump, len(dump)); err == nil {
+				// discard samples captured whilst the tuner settles
+				err = readFull(dongle.dev, buf)
+				if err != nil {
+					r.logf("ReadSync failed, err %s\n", err)
+				}
+			}
+			if err != nil {
+				if !r.reconnect(err) {
+					return
+				}
+				// abandon the rest of this sweep
+				break
+			}
+
+			for i := range acc {
+				acc[i] = 0
+			}
+			for i := 0; i < ffts; i++ {
+				powerSpectrum(buf[2*n*i:2*n*(i+1)], window, scratch, acc)
+			}
+			p.row(w, now, low, acc)
+		}
+
+		if err = w.Flush(); err != nil {
+			r.logf("output write error: %s\n", err)
+		}
+
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readFull fills buf from the dongle using synchronous reads
+func readFull(dev *rtl.Context, buf []byte) error {
+	for read := 0; read < len(buf); {
+		n, err := dev.ReadSync(buf[read:], len(buf)-read)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("short read")
+		}
+		read += n
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, write to the Free Software Foundation, Inc.,
+// 51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSurveyPlan(t *testing.T) {
+	tests := []struct {
+		spec     string
+		interval time.Duration
+		want     surveyPlan
+	}{
+		{"88M:108M:10k", 10 * time.Second, surveyPlan{256, 204, 26, 13, 64, 8000, 1632000}},
+		{"144M:146M:1k", time.Second, surveyPlan{2048, 1638, 205, 2, 64, 1000, 1638000}},
+		// too many hops to average more than one FFT each
+		{"400M:1700M:1k", time.Second, surveyPlan{2048, 1638, 205, 794, 1, 1000, 1638000}},
+		{"100M:101M:100k", time.Millisecond, surveyPlan{256, 204, 26, 1, 8, 8000, 1632000}},
+	}
+	for _, tt := range tests {
+		s := &surveyState{spec: tt.spec, interval: tt.interval}
+		if err := s.parse(); err != nil {
+			t.Fatalf("parse(%q): %v", tt.spec, err)
+		}
+		if got := s.plan(); got != tt.want {
+			t.Errorf("plan(%q, %s) = %+v, want %+v", tt.spec, tt.interval, got, tt.want)
+		}
+	}
+}
+
+func TestSurveyRow(t *testing.T) {
+	p := surveyPlan{n: 8, usable: 6, first: 1, ffts: 2, binWidth: 256000, hopWidth: 1536000}
+	now := time.Date(2026, 10, 18, 12, 34, 56, 0, time.UTC)
+	tests := []struct {
+		low  float64
+		acc  []float64
+		want string
+	}{
+		// the DC bin, 4, is replaced by the mean of its neighbours
+		{144000000, []float64{2, 2, 20, 2, 999, 200, 2, 2},
+			"2026-10-18, 12:34:56, 144000000, 145536000, 256000.00, 16, 0.00, 10.00, 0.00, 17.03, 20.00, 0.00\n"},
+		{88000000, []float64{0.2, 0.2, 0.2, 2, 0, 2, 20, 0.2},
+			"2026-10-18, 12:34:56, 88000000, 89536000, 256000.00, 16, -10.00, -10.00, 0.00, 0.00, 0.00, 10.00\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		p.row(&buf, now, tt.low, tt.acc)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("row(%.0f, %v) =\n%q, want\n%q", tt.low, tt.acc, got, tt.want)
+		}
+	}
+}